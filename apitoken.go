@@ -0,0 +1,100 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/base64"
+import "encoding/hex"
+import "errors"
+import "net/http"
+import "strings"
+import "time"
+
+// API tokens grant any of these scopes: posting to the token owner's feed,
+// and changing their account settings.
+const scopePost = "post"
+const scopeAccount = "account"
+
+var apiScopes = []string{scopePost, scopeAccount}
+
+func apiTokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken returns the token r's Authorization header carries, or "".
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) < len(prefix) ||
+		!strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+func (t apiToken) hasScope(scope string) bool {
+	for _, granted := range strings.Split(t.scopes, ",") {
+		if scope == granted {
+			return true
+		}
+	}
+	return false
+}
+
+// newAPIToken mints a token for name, stores its hash and returns the token.
+func newAPIToken(name, label string, scopes []string) (string, error) {
+	if "" == label || len(label) > 140 || strings.ContainsAny(label,
+		"\t\n\r") {
+		return "", errors.New("Illegal API token label.")
+	} else if 0 == len(scopes) {
+		return "", errors.New("API token needs at least one scope.")
+	}
+	for _, scope := range scopes {
+		legal := false
+		for _, known := range apiScopes {
+			legal = legal || scope == known
+		}
+		if !legal {
+			return "", errors.New("Illegal API token scope.")
+		}
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	err := store.addAPIToken(apiToken{id: apiTokenID(token), name: name,
+		label: label, scopes: strings.Join(scopes, ","),
+		created: int(time.Now().Unix())})
+	if err == errExists {
+		return "", errors.New("API token label already in use.")
+	}
+	return token, err
+}
+
+// apiTokenLogin returns the name of the user who owns token, provided it
+// grants scope.
+func apiTokenLogin(w http.ResponseWriter, r *http.Request, token,
+	scope string) (string, error) {
+	if "" == scope {
+		execTemplate(w, r, "error.html",
+			"API tokens are not accepted here.")
+		return "", errors.New("")
+	}
+	t, err := store.getAPIToken(apiTokenID(token))
+	if err == errNotFound {
+		execTemplate(w, r, "error_login.html", "Bad login.")
+		return "", err
+	} else if err != nil {
+		serverError(w, r, err)
+		return "", err
+	}
+	if !t.hasScope(scope) {
+		execTemplate(w, r, "error.html",
+			"API token lacks the scope \""+scope+"\".")
+		return "", errors.New("")
+	}
+	return t.name, nil
+}
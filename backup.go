@@ -0,0 +1,322 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "archive/tar"
+import "bufio"
+import "bytes"
+import "compress/gzip"
+import "crypto/sha256"
+import "encoding/hex"
+import "errors"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+import "time"
+
+// Besides the data directory's files, named by their paths relative to it,
+// backup archives hold a manifest of their SHA-256 checksums and, if a
+// database is in use, a copy of it.
+const backupManifest = "MANIFEST"
+const backupDatabase = "database"
+
+var backupPath string
+var restorePath string
+
+func dataFileNames() []string {
+	return []string{versionFile, loginsFile, pwResetFile, pwResetWaitFile,
+		ipDelaysFile, sessionsFile, apiTokensFile, twoFactorFile,
+		accountDelaysFile, mailVerifyFile}
+}
+
+// backupNames lists what of the data directory goes into a backup.
+func backupNames() ([]string, error) {
+	names := dataFileNames()
+	files, err := ioutil.ReadDir(feedsPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), ".") {
+			names = append(names, feedsDir+"/"+file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func addToArchive(archive *tar.Writer, manifest *bytes.Buffer, name string,
+	content []byte) error {
+	header := &tar.Header{Name: name, Mode: 0600,
+		Size: int64(len(content)), ModTime: time.Now(),
+		Typeflag: tar.TypeReg}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := archive.Write(content); err != nil {
+		return err
+	}
+	if nil != manifest {
+		sum := sha256.Sum256(content)
+		manifest.WriteString(hex.EncodeToString(sum[:]) + "  " + name +
+			"\n")
+	}
+	return nil
+}
+
+// writeBackup archives the data directory (and database, if dbStore is not
+// nil) to path. It holds shared locks on all files while reading them, so a
+// running server may keep serving reads but has to wait with its writes
+// until the snapshot is complete.
+func writeBackup(path string, dbStore *sqliteStorage) error {
+	names, err := backupNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		unlock, err := lockFile(dataDir+"/"+name, false)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path),
+		"."+filepath.Base(path)+"_tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+	compressor := gzip.NewWriter(tmpFile)
+	archive := tar.NewWriter(compressor)
+	var manifest bytes.Buffer
+	for _, name := range names {
+		content, err := ioutil.ReadFile(dataDir + "/" + name)
+		if err != nil {
+			return err
+		}
+		err = addToArchive(archive, &manifest, name, content)
+		if err != nil {
+			return err
+		}
+	}
+	if nil != dbStore {
+		content, err := dbStore.snapshot()
+		if err != nil {
+			return err
+		}
+		err = addToArchive(archive, &manifest, backupDatabase, content)
+		if err != nil {
+			return err
+		}
+	}
+	err = addToArchive(archive, nil, backupManifest, manifest.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// snapshot returns a consistent copy of the database even while it's in use.
+func (s sqliteStorage) snapshot() ([]byte, error) {
+	tmpDir, err := ioutil.TempDir("", "htwtxt_backup")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpPath := tmpDir + "/" + backupDatabase
+	if _, err := s.db.Exec(`VACUUM INTO ?`, tmpPath); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(tmpPath)
+}
+
+func isBackupName(name string) bool {
+	if backupManifest == name || backupDatabase == name {
+		return true
+	}
+	for _, dataFile := range dataFileNames() {
+		if dataFile == name {
+			return true
+		}
+	}
+	feed := strings.TrimPrefix(name, feedsDir+"/")
+	return feed != name && "" != feed && onlyLegalRunes(feed)
+}
+
+// readBackup reads the archive at path fully and checks that it contains
+// nothing but what writeBackup puts there, all of it matching the manifest.
+func readBackup(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decompressor, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	archive := tar.NewReader(decompressor)
+	contents := make(map[string][]byte)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if tar.TypeReg != header.Typeflag ||
+			!isBackupName(header.Name) {
+			return nil, errors.New("Unexpected archive entry: " +
+				header.Name)
+		} else if _, ok := contents[header.Name]; ok {
+			return nil, errors.New("Duplicate archive entry: " +
+				header.Name)
+		}
+		content, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return nil, err
+		}
+		contents[header.Name] = content
+	}
+	manifest, ok := contents[backupManifest]
+	if !ok {
+		return nil, errors.New("Archive has no " + backupManifest + ".")
+	}
+	delete(contents, backupManifest)
+	listed := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(manifest))
+	for scanner.Scan() {
+		tokens := strings.SplitN(scanner.Text(), "  ", 2)
+		if 2 != len(tokens) {
+			return nil, errors.New("Malformed " + backupManifest +
+				".")
+		}
+		content, ok := contents[tokens[1]]
+		if !ok {
+			return nil, errors.New("Archive lacks " + tokens[1] +
+				".")
+		}
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != tokens[0] {
+			return nil, errors.New("Checksum mismatch for " +
+				tokens[1] + ".")
+		}
+		listed[tokens[1]] = true
+	}
+	for name := range contents {
+		if !listed[name] {
+			return nil, errors.New(name + " is missing from " +
+				backupManifest + ".")
+		}
+	}
+	// Data files that may be missing from archives made by older versions
+	// are created anew on the next start.
+	for _, name := range []string{versionFile, loginsFile} {
+		if _, ok := contents[name]; !ok {
+			return nil, errors.New("Archive lacks " + name + ".")
+		}
+	}
+	return contents, nil
+}
+
+func writeLocked(path string, content []byte) error {
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeAtomic(path, string(content))
+}
+
+func removeLocked(path string) error {
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return os.Remove(path)
+}
+
+// restoreBackup replaces the data directory's contents (and the database's,
+// if dbPath is set) with those of the archive at path, once it has been
+// verified by readBackup. Feeds not in the archive are removed. As it is
+// there to repair damaged data directories, it expects nothing of dataDir
+// but that initPaths has been run on it.
+func restoreBackup(path string) error {
+	contents, err := readBackup(path)
+	if err != nil {
+		return errors.New("Archive failed verification: " + err.Error())
+	}
+	_, hasDatabase := contents[backupDatabase]
+	if hasDatabase && "" == dbPath {
+		return errors.New("Archive holds a database, but no --db is " +
+			"set to restore it to.")
+	} else if !hasDatabase && "" != dbPath {
+		return errors.New("Archive holds no database to restore to " +
+			"--db.")
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(
+		string(contents[versionFile])))
+	if err != nil {
+		return errors.New("Can't parse archive's " + versionFile + ".")
+	} else if version > schemaVersion {
+		return versionMismatch("Archive", version)
+	}
+	if err := os.MkdirAll(feedsPath, 0700); err != nil {
+		return err
+	}
+	names, err := backupNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, ok := contents[name]; !ok {
+			err := removeLocked(dataDir + "/" + name)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	for name, content := range contents {
+		if backupDatabase == name {
+			continue
+		}
+		if err := writeLocked(dataDir+"/"+name, content); err != nil {
+			return err
+		}
+	}
+	if hasDatabase {
+		for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+			err := os.Remove(dbPath + suffix)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		err := ioutil.WriteFile(dbPath+"_restore",
+			contents[backupDatabase], 0600)
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(dbPath+"_restore", dbPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
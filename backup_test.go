@@ -0,0 +1,137 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "archive/tar"
+import "compress/gzip"
+import "crypto/sha256"
+import "encoding/hex"
+import "io/ioutil"
+import "os"
+import "strings"
+import "testing"
+
+type testEntry struct {
+	name     string
+	content  string
+	typeflag byte
+}
+
+func writeTestArchive(path string, entries []testEntry) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	compressor := gzip.NewWriter(file)
+	archive := tar.NewWriter(compressor)
+	for _, entry := range entries {
+		typeflag := entry.typeflag
+		if 0 == typeflag {
+			typeflag = tar.TypeReg
+		}
+		header := &tar.Header{Name: entry.name, Mode: 0600,
+			Size: int64(len(entry.content)), Typeflag: typeflag}
+		if tar.TypeReg != typeflag {
+			header.Size = 0
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if tar.TypeReg == typeflag {
+			_, err := archive.Write([]byte(entry.content))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return compressor.Close()
+}
+
+// listed returns the manifest line for name holding content.
+func listed(name, content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:]) + "  " + name + "\n"
+}
+
+func TestReadBackup(t *testing.T) {
+	const loginsContent = "foo\thash\n"
+	var data []testEntry
+	manifest := ""
+	for _, name := range dataFileNames() {
+		content := ""
+		if versionFile == name {
+			content = "2\n"
+		} else if loginsFile == name {
+			content = loginsContent
+		}
+		if loginsFile != name {
+			data = append(data, testEntry{name: name,
+				content: content})
+		}
+		manifest += listed(name, content)
+	}
+	// archive returns the data files with logins and extra added.
+	archive := func(logins []testEntry, extra ...testEntry) []testEntry {
+		entries := append([]testEntry{}, data...)
+		return append(append(entries, logins...), extra...)
+	}
+	logins := []testEntry{{name: loginsFile, content: loginsContent}}
+	feed := testEntry{name: feedsDir + "/foo", content: "twt\n"}
+	listing := func(content string) testEntry {
+		return testEntry{name: backupManifest, content: content}
+	}
+	withFeed := manifest + listed(feedsDir+"/foo", "twt\n")
+	noLogins := strings.Replace(manifest,
+		listed(loginsFile, loginsContent), "", 1)
+	tests := []struct {
+		entries []testEntry
+		err     string
+	}{
+		{archive(logins, listing(manifest)), ""},
+		{archive(logins, feed, listing(withFeed)), ""},
+		{archive(logins), "has no MANIFEST"},
+		{archive(logins, feed, listing(manifest)),
+			"missing from MANIFEST"},
+		{archive(logins, listing(withFeed)), "lacks feeds/foo"},
+		{archive([]testEntry{{name: loginsFile, content: "bar\n"}},
+			listing(manifest)), "Checksum mismatch"},
+		{archive(nil, listing(noLogins)), "lacks logins"},
+		{archive(logins, listing("garbage\n")), "Malformed MANIFEST"},
+		{archive(append(logins, logins...), listing(manifest)),
+			"Duplicate archive entry"},
+		{archive(logins, testEntry{name: "../escape"},
+			listing(manifest)), "Unexpected archive entry"},
+		{archive(logins, testEntry{name: feedsDir + "/../x"},
+			listing(manifest)), "Unexpected archive entry"},
+		{archive(logins, testEntry{name: feedsDir + "/bar",
+			typeflag: tar.TypeSymlink}, listing(manifest)),
+			"Unexpected archive entry"},
+	}
+	path := t.TempDir() + "/backup.tar.gz"
+	for i, test := range tests {
+		if err := writeTestArchive(path, test.entries); err != nil {
+			t.Fatal(err)
+		}
+		contents, err := readBackup(path)
+		if "" == test.err {
+			if err != nil {
+				t.Errorf("case %d: %v", i, err)
+			} else if len(contents) != len(test.entries)-1 {
+				t.Errorf("case %d: got %d files, want %d", i,
+					len(contents), len(test.entries)-1)
+			}
+		} else if err == nil || !strings.Contains(err.Error(),
+			test.err) {
+			t.Errorf("case %d: got error %v, want %q", i, err,
+				test.err)
+		}
+	}
+	ioutil.WriteFile(path, []byte("not gzipped"), 0600)
+	if _, err := readBackup(path); err == nil {
+		t.Error("archive not gzipped accepted")
+	}
+}
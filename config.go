@@ -0,0 +1,142 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "bufio"
+import "flag"
+import "os"
+import "sort"
+import "strconv"
+import "strings"
+
+// Options are taken from the command line first, then from environment
+// variables named like the flags with the prefix HTWTXT_, upper-cased and with
+// dashes turned into underscores, then from the config file, and lastly from
+// the flags' defaults.
+const envPrefix = "HTWTXT_"
+
+var configPath string
+
+// Flags that make htwtxt do a single task instead of serving are only taken
+// from the command line, lest a config file or environment left in place
+// keep turning every start into that task.
+var commandLineOnly = map[string]bool{"adduser": true, "backup": true,
+	"dbimport": true, "migrate": true, "restore": true, "unlock": true,
+	"version": true}
+
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// readConfigFile reads options from lines of NAME = VALUE or NAME: VALUE,
+// whichever separator comes first, VALUE optionally quoted. Empty lines,
+// comments starting with # or ;, [section] headers and --- document markers
+// are skipped, so flat INI, TOML and YAML files can be used as is.
+func readConfigFile(path string) (map[string]string, []string) {
+	values := map[string]string{}
+	file, err := os.Open(path)
+	if err != nil {
+		return values, []string{"Can't read config file: " +
+			err.Error()}
+	}
+	defer file.Close()
+	var problems []string
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if "" == line || strings.HasPrefix(line, "#") ||
+			strings.HasPrefix(line, ";") || "---" == line ||
+			(strings.HasPrefix(line, "[") &&
+				strings.HasSuffix(line, "]")) {
+			continue
+		}
+		where := path + ":" + strconv.Itoa(n) + ": "
+		separator := "="
+		colon := strings.Index(line, ":")
+		if equals := strings.Index(line, "="); -1 != colon &&
+			(-1 == equals || colon < equals) {
+			separator = ":"
+		}
+		tokens := strings.SplitN(line, separator, 2)
+		name := strings.TrimSpace(tokens[0])
+		if 2 != len(tokens) || "" == name {
+			problems = append(problems,
+				where+"Expected NAME = VALUE.")
+			continue
+		}
+		value := strings.TrimSpace(tokens[1])
+		if strings.HasPrefix(value, `"`) {
+			value, err = strconv.Unquote(value)
+			if err != nil {
+				problems = append(problems,
+					where+"Bad quoting.")
+				continue
+			}
+		} else if 2 <= len(value) && strings.HasPrefix(value, "'") &&
+			strings.HasSuffix(value, "'") {
+			value = value[1 : len(value)-1]
+		}
+		if _, ok := values[name]; ok {
+			problems = append(problems, where+"Repeated "+name+".")
+		}
+		values[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		problems = append(problems, "Can't read config file: "+
+			err.Error())
+	}
+	return values, problems
+}
+
+// applyConfig sets the flags not given on the command line, other than the
+// commandLineOnly ones, from the environment or the config file, and returns
+// all problems met doing so.
+func applyConfig() []string {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["config"] {
+		if path, ok := os.LookupEnv(envName("config")); ok {
+			configPath = path
+		}
+	}
+	values := map[string]string{}
+	var problems []string
+	if "" != configPath {
+		values, problems = readConfigFile(configPath)
+		var names []string
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if nil == flag.Lookup(name) || "config" == name {
+				problems = append(problems, configPath+
+					": Unknown option "+name+".")
+			} else if commandLineOnly[name] {
+				problems = append(problems, configPath+
+					": Option "+name+" only works on the "+
+					"command line.")
+			}
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || "config" == f.Name ||
+			commandLineOnly[f.Name] {
+			return
+		}
+		source := envName(f.Name)
+		value, ok := os.LookupEnv(source)
+		if !ok {
+			source = configPath
+			value, ok = values[f.Name]
+		}
+		if !ok {
+			return
+		}
+		if err := f.Value.Set(value); err != nil {
+			problems = append(problems, "Bad value for "+f.Name+
+				" from "+source+": "+err.Error())
+		}
+	})
+	return problems
+}
@@ -0,0 +1,60 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "io/ioutil"
+import "reflect"
+import "strings"
+import "testing"
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		text     string
+		values   map[string]string
+		problems []string
+	}{
+		{"port = 8443\nsignup=true\n", map[string]string{
+			"port": "8443", "signup": "true"}, nil},
+		{"# comment\n; comment\n[server]\n---\n\nport: 8443\n",
+			map[string]string{"port": "8443"}, nil},
+		{"contact = \"Alice <a@b.c>\"\nsitename = 'my site'\n",
+			map[string]string{"contact": "Alice <a@b.c>",
+				"sitename": "my site"}, nil},
+		{"mailfrom: a=b\ncsp = a: b\n", map[string]string{
+			"mailfrom": "a=b", "csp": "a: b"}, nil},
+		{"contact =\n", map[string]string{"contact": ""}, nil},
+		{"port\n= 8000\n", map[string]string{},
+			[]string{":1: Expected", ":2: Expected"}},
+		{"contact = \"open\n", map[string]string{},
+			[]string{":1: Bad quoting."}},
+		{"port = 1\nport = 2\n", map[string]string{"port": "2"},
+			[]string{":2: Repeated port."}},
+	}
+	path := t.TempDir() + "/htwtxt.conf"
+	for _, test := range tests {
+		err := ioutil.WriteFile(path, []byte(test.text), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values, problems := readConfigFile(path)
+		if !reflect.DeepEqual(test.values, values) {
+			t.Errorf("%q: got %v, want %v", test.text, values,
+				test.values)
+		}
+		if len(test.problems) != len(problems) {
+			t.Errorf("%q: got problems %q, want %q", test.text,
+				problems, test.problems)
+			continue
+		}
+		for i, problem := range problems {
+			if !strings.Contains(problem, test.problems[i]) {
+				t.Errorf("%q: got problem %q, want %q",
+					test.text, problem, test.problems[i])
+			}
+		}
+	}
+	_, problems := readConfigFile(path + "_missing")
+	if 1 != len(problems) {
+		t.Errorf("missing file: got problems %q", problems)
+	}
+}
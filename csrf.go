@@ -0,0 +1,150 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/base64"
+import "net"
+import "net/http"
+import "net/url"
+import "strings"
+
+// Every POST form carries a token derived from a random value the client is
+// handed as cookie and from the path the form posts to, so that pages of
+// other sites can neither make browsers post to us nor reuse one form's token
+// for another. Some requests can't be forged that way and so may do without,
+// see exemptFromToken.
+const csrfCookie = "csrf"
+const csrfField = "csrf"
+const csrfKeyFile = "csrf_key"
+
+var csrfKey []byte
+
+// csrfForms hands templates the tokens for their forms.
+type csrfForms struct {
+	secret string
+}
+
+// For returns the token to post to the path action with.
+func (c csrfForms) For(action string) string {
+	return csrfToken(c.secret, action)
+}
+
+func csrfToken(secret, action string) string {
+	mac := hmac.New(sha256.New, csrfKey)
+	mac.Write([]byte(secret + "\n" + action))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// csrfFormsFor returns the forms' tokens for the client that made r, handing
+// it a new cookie to derive them from if it carries none yet.
+func csrfFormsFor(w http.ResponseWriter, r *http.Request) csrfForms {
+	cookie, err := r.Cookie(csrfCookie)
+	if err == nil && "" != cookie.Value {
+		return csrfForms{secret: cookie.Value}
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		logRequestError(r, err)
+		return csrfForms{}
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{Name: csrfCookie, Value: secret,
+		Path: "/", HttpOnly: true, Secure: "" != keyPath,
+		SameSite: http.SameSiteLaxMode})
+	return csrfForms{secret: secret}
+}
+
+// requestHosts returns the hosts r may legitimately originate from: the one
+// it was sent to and, if it comes from a trusted proxy, the one the proxy was
+// asked for.
+func requestHosts(r *http.Request) []string {
+	hosts := []string{r.Host}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !isTrustedProxy(net.ParseIP(host)) {
+		return hosts
+	}
+	forwarded := r.Header["X-Forwarded-Host"]
+	if 0 != len(forwarded) {
+		values := strings.Split(forwarded[len(forwarded)-1], ",")
+		hosts = append(hosts,
+			strings.TrimSpace(values[len(values)-1]))
+	}
+	return hosts
+}
+
+// sameOrigin returns whether r's Origin header or, lacking that, its Referer
+// header names one of our own hosts. Requests with neither pass, as browsers
+// send at least one of them with any cross-site POST.
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if "" == source {
+		source = r.Header.Get("Referer")
+		if "" == source {
+			return true
+		}
+	}
+	u, err := url.Parse(source)
+	if err != nil || "" == u.Host {
+		return false
+	}
+	for _, host := range requestHosts(r) {
+		if strings.EqualFold(u.Host, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// exemptFromToken returns whether r may do without a token: if it logs in by
+// API token, which browsers never send on their own; if it logs in by HTTP
+// Basic, which browsers do add to cross-site requests once cached, but
+// carries neither form token nor session cookie, so comes from no browser
+// that has used our pages; or if it carries no session cookie but name and
+// password, which forging takes knowing the password. Logging in always
+// needs a token, lest other sites log visitors in as someone else.
+func exemptFromToken(r *http.Request) bool {
+	if "/login" == r.URL.Path {
+		return false
+	}
+	_, err := r.Cookie(sessionCookie)
+	hasSession := err == nil
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return true
+	} else if strings.HasPrefix(auth, "Basic ") {
+		_, err := r.Cookie(csrfCookie)
+		return !hasSession && err != nil
+	}
+	return !hasSession && "" != r.PostFormValue("name") &&
+		"" != r.PostFormValue("password")
+}
+
+// csrfChecked wraps handler to refuse requests from foreign origins or
+// lacking a valid token for the path they post to.
+func csrfChecked(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !sameOrigin(r) {
+			execTemplateStatus(w, r, http.StatusForbidden,
+				"error.html",
+				"Request from foreign origin refused.")
+			return
+		}
+		if exemptFromToken(r) {
+			handler(w, r)
+			return
+		}
+		cookie, err := r.Cookie(csrfCookie)
+		if err != nil || "" == cookie.Value || !hmac.Equal(
+			[]byte(r.PostFormValue(csrfField)),
+			[]byte(csrfToken(cookie.Value, r.URL.Path))) {
+			execTemplateStatus(w, r, http.StatusForbidden,
+				"error.html", "Form token missing or invalid; "+
+					"reload the form and try again.")
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,96 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "html/template"
+import "net/http"
+import "net/http/httptest"
+import "net/url"
+import "strings"
+import "testing"
+
+func TestCSRFChecked(t *testing.T) {
+	var err error
+	templ, err = template.New("main").ParseGlob("templates/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrfKey = []byte("0123456789abcdef0123456789abcdef")
+	handler := csrfChecked(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("passed"))
+	})
+	token := func(path string) string { return csrfToken("secret", path) }
+	credentials := url.Values{"name": {"foo"}, "password": {"bar"}}
+	tests := []struct {
+		path    string
+		header  http.Header
+		cookies []string
+		form    url.Values
+		passes  bool
+	}{
+		{"/feeds", http.Header{}, nil, url.Values{}, false},
+		{"/feeds", http.Header{}, []string{csrfCookie},
+			url.Values{csrfField: {token("/feeds")}}, true},
+		{"/feeds", http.Header{}, nil,
+			url.Values{csrfField: {token("/feeds")}}, false},
+		{"/feeds", http.Header{}, []string{csrfCookie},
+			url.Values{csrfField: {token("/account")}}, false},
+		{"/feeds", http.Header{}, []string{csrfCookie},
+			url.Values{csrfField: {"forged"}}, false},
+		{"/feeds", http.Header{"Origin": {"http://example.com"}},
+			[]string{csrfCookie},
+			url.Values{csrfField: {token("/feeds")}}, true},
+		{"/feeds", http.Header{"Origin": {"http://evil.example"}},
+			[]string{csrfCookie},
+			url.Values{csrfField: {token("/feeds")}}, false},
+		{"/feeds", http.Header{"Referer": {"http://evil.example/"}},
+			[]string{csrfCookie},
+			url.Values{csrfField: {token("/feeds")}}, false},
+		{"/feeds", http.Header{"Authorization": {"Bearer x"}},
+			[]string{csrfCookie, sessionCookie}, url.Values{},
+			true},
+		{"/feeds", http.Header{"Authorization": {"Basic x"}}, nil,
+			url.Values{}, true},
+		{"/feeds", http.Header{"Authorization": {"Basic x"}},
+			[]string{csrfCookie}, url.Values{}, false},
+		{"/feeds", http.Header{"Authorization": {"Basic x"}},
+			[]string{sessionCookie}, url.Values{}, false},
+		{"/feeds", http.Header{"Authorization": {"Basic x"}},
+			[]string{csrfCookie}, credentials, false},
+		{"/feeds", http.Header{"Authorization": {"Basic x"}},
+			[]string{csrfCookie},
+			url.Values{csrfField: {token("/feeds")}}, true},
+		{"/feeds", http.Header{}, nil, credentials, true},
+		{"/feeds", http.Header{}, nil,
+			url.Values{"name": {"foo"}}, false},
+		{"/feeds", http.Header{}, []string{sessionCookie},
+			credentials, false},
+		{"/login", http.Header{}, nil, credentials, false},
+		{"/login", http.Header{"Authorization": {"Basic x"}}, nil,
+			url.Values{}, false},
+		{"/login", http.Header{"Authorization": {"Bearer x"}}, nil,
+			url.Values{}, false},
+		{"/login", http.Header{}, []string{csrfCookie},
+			url.Values{"name": {"foo"}, "password": {"bar"},
+				csrfField: {token("/login")}}, true},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("POST", test.path,
+			strings.NewReader(test.form.Encode()))
+		r.Header = test.header
+		r.Header.Set("Content-Type",
+			"application/x-www-form-urlencoded")
+		for _, name := range test.cookies {
+			r.AddCookie(&http.Cookie{Name: name, Value: "secret"})
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		passed := "passed" == w.Body.String()
+		if test.passes != passed {
+			t.Errorf("case %d: got passed %v, status %d", i,
+				passed, w.Code)
+		} else if !passed && http.StatusForbidden != w.Code {
+			t.Errorf("case %d: got status %d", i, w.Code)
+		}
+	}
+}
@@ -1,193 +1,243 @@
 package main
 
-import "bufio"
+import "bytes"
 import "crypto/rand"
+import "crypto/sha256"
+import "crypto/subtle"
 import "encoding/base64"
-import "golang.org/x/crypto/bcrypt"
-import "gopkg.in/gomail.v2"
-import "log"
+import "encoding/hex"
+import "errors"
 import "github.com/gorilla/mux"
+import "html/template"
 import "net/http"
-import "os"
-import "strconv"
 import "strings"
 import "time"
 
 func passwordResetRequestGetHandler(w http.ResponseWriter, r *http.Request) {
-	if "" == mailuser {
-		execTemplate(w, "nopwresetrequest.html", "")
+	if !mailEnabled() {
+		execTemplate(w, r, "nopwresetrequest.html", "")
 	} else {
-		execTemplate(w, "pwresetrequest.html", "")
+		execTemplate(w, r, "pwresetrequest.html", "")
 	}
 }
 
 func passwordResetRequestPostHandler(w http.ResponseWriter, r *http.Request) {
-	preparePasswordReset := func(name string) {
-		if "" == mailuser {
-			return
+	preparePasswordReset := func(name string) error {
+		if !mailEnabled() {
+			return nil
 		}
 		now := int(time.Now().Unix())
-		tokens, errWait := getFromFileEntryFor(pwResetWaitPath, name, 2)
-		if errWait == nil {
-			lastTime, err := strconv.Atoi(tokens[0])
-			if err != nil {
-				log.Fatal("Trouble parsing password reset "+
-					"wait times", err)
-			}
+		lastTime, err := store.getPwResetWait(name)
+		if err == nil {
 			if lastTime+resetWaitTime >= now {
-				return
+				return nil
 			}
+		} else if err != errNotFound {
+			return err
 		}
-		var target string
-		tokens, err := getFromFileEntryFor(loginsPath, name, 5)
-		if err != nil {
-			return
-		} else if "" == tokens[1] {
-			return
+		u, err := store.getUser(name)
+		if err == errNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		} else if "" == u.mail {
+			return nil
 		}
-		target = tokens[1]
-		b := make([]byte, 64)
-		if _, err := rand.Read(b); err != nil {
-			log.Fatal("Random string generation failed", err)
+		urlPart, err := newLinkSecret()
+		if err != nil {
+			return err
 		}
-		urlPart := base64.URLEncoding.EncodeToString(b)
-		strTime := strconv.Itoa(now)
-		appendToFile(pwResetPath, urlPart+"\t"+name+"\t"+strTime)
-		m := gomail.NewMessage()
-		m.SetHeader("From", mailuser)
-		m.SetHeader("To", target)
-		m.SetHeader("Subject", "password reset link")
-		msg := myself + "/passwordreset/" + urlPart
-		m.SetBody("text/plain", msg)
-		if err := dialer.DialAndSend(m); err != nil {
-			log.Fatal("Can't send mail", err)
+		selector, hash := splitLinkSecret(urlPart)
+		err = store.addPwReset(selector, hash, name, now)
+		if err != nil {
+			return err
 		}
-		line := name + "\t" + strTime
-		if nil == errWait {
-			replaceLineStartingWith(pwResetWaitPath, name, line)
-		} else {
-			appendToFile(pwResetWaitPath, line)
+		err = sendMail(u.mail, "pwreset", mailData{Name: name,
+			Link:    myself + "/passwordreset/" + urlPart,
+			Expires: time.Unix(int64(now+resetLinkExp), 0)})
+		if err != nil {
+			return err
 		}
+		return store.setPwResetWait(name, now)
 	}
-	go preparePasswordReset(r.FormValue("name"))
+	name := r.FormValue("name")
+	go func() {
+		if err := preparePasswordReset(name); err != nil {
+			logRequestError(r, err)
+		}
+	}()
 	http.Redirect(w, r, "/", 302)
 }
 
-func passwordResetLinkGetHandler(w http.ResponseWriter, r *http.Request) {
-	urlPart := mux.Vars(r)["secret"]
-	tokens, err := getFromFileEntryFor(pwResetPath, urlPart, 3)
-	if err != nil {
-		http.Redirect(w, r, "/404", 302)
-		return
+// newLinkSecret returns the secret for a new link to mail, made of a selector
+// and a verifier part.
+func newLinkSecret() (string, error) {
+	selector := make([]byte, 16)
+	verifier := make([]byte, 32)
+	if _, err := rand.Read(selector); err != nil {
+		return "", err
+	} else if _, err := rand.Read(verifier); err != nil {
+		return "", err
 	}
-	createTime, err := strconv.Atoi(tokens[1])
-	if err != nil {
-		log.Fatal("Can't read time from pw reset file", err)
+	return base64.RawURLEncoding.EncodeToString(selector) + "." +
+		base64.RawURLEncoding.EncodeToString(verifier), nil
+}
+
+// splitLinkSecret splits a mailed link's secret into the selector to store
+// and look up its entry by, and the hash of the rest, so that whoever reads
+// the stored entries still can't use them.
+func splitLinkSecret(urlPart string) (string, string) {
+	tokens := strings.SplitN(urlPart, ".", 2)
+	if 2 != len(tokens) {
+		return urlPart, ""
+	}
+	sum := sha256.Sum256([]byte(tokens[1]))
+	return tokens[0], hex.EncodeToString(sum[:])
+}
+
+// getValidPwReset returns the name and selector of the unexpired password
+// reset link whose secret is urlPart.
+func getValidPwReset(w http.ResponseWriter, r *http.Request,
+	urlPart string) (string, string, error) {
+	selector, hash := splitLinkSecret(urlPart)
+	name, storedHash, createTime, err := store.getPwReset(selector)
+	if err == nil && ("" == hash || 1 != subtle.ConstantTimeCompare(
+		[]byte(hash), []byte(storedHash))) {
+		err = errNotFound
+	}
+	if err == errNotFound {
+		http.Redirect(w, r, "/404", 302)
+		return "", "", err
+	} else if err != nil {
+		serverError(w, r, err)
+		return "", "", err
 	}
 	if createTime+resetLinkExp < int(time.Now().Unix()) {
 		http.Redirect(w, r, "/404", 302)
+		return "", "", errors.New("")
+	}
+	return name, selector, nil
+}
+
+func passwordResetLinkGetHandler(w http.ResponseWriter, r *http.Request) {
+	urlPart := mux.Vars(r)["secret"]
+	name, _, err := getValidPwReset(w, r, urlPart)
+	if err != nil {
 		return
 	}
-	name := tokens[0]
-	tokensUser, err := getFromFileEntryFor(loginsPath, name,
-		5)
+	u, err := store.getUser(name)
 	if err != nil {
-		log.Fatal("Can't read from loings file", err)
+		serverError(w, r, err)
+		return
 	}
-	if "" != tokensUser[2] {
+	if "" != u.secQuestion {
 		type data struct {
 			Secret   string
 			Question string
+			CSRF     csrfForms
 		}
-		err := templ.ExecuteTemplate(w,
-			"pwresetquestion.html", data{
-				Secret:   urlPart,
-				Question: tokensUser[2]})
-		if err != nil {
-			log.Fatal("Trouble executing template", err)
-		}
+		renderTemplate(w, r, "pwresetquestion.html", data{
+			Secret:   urlPart,
+			Question: u.secQuestion,
+			CSRF:     csrfFormsFor(w, r)})
 		return
 	}
-	execTemplate(w, "pwreset.html", urlPart)
+	execTemplate(w, r, "pwreset.html", urlPart)
 }
 
 func passwordResetLinkPostHandler(w http.ResponseWriter, r *http.Request) {
 	urlPart := mux.Vars(r)["secret"]
 	name := r.FormValue("name")
-	tokens, err := getFromFileEntryFor(pwResetPath, urlPart, 3)
+	resetName, selector, err := getValidPwReset(w, r, urlPart)
 	if err != nil {
-		http.Redirect(w, r, "/404", 302)
 		return
 	}
-	createTime, err := strconv.Atoi(tokens[1])
-	if err != nil {
-		log.Fatal("Can't read time from pw reset file", err)
+	wrongAnswer := func() {
+		if err := store.removePwReset(selector); err != nil {
+			serverError(w, r, err)
+			return
+		}
+		execTemplate(w, r, "error.html", "Wrong answer(s).")
 	}
-	if createTime+resetLinkExp < int(time.Now().Unix()) {
-		http.Redirect(w, r, "/404", 302)
+	if resetName != name {
+		wrongAnswer()
 		return
 	}
-	if tokens[0] != name {
-		execTemplate(w, "error.html", "Wrong answer(s).")
-		removeLineStartingWith(pwResetPath, urlPart)
+	u, err := store.getUser(name)
+	if err != nil {
+		serverError(w, r, err)
 		return
 	}
-	tokensUser, err := getFromFileEntryFor(loginsPath, name, 5)
+	if "" != u.secQuestion &&
+		!pwMatchesHash(u.secAnswer, r.FormValue("secanswer")) {
+		wrongAnswer()
+		return
+	}
+	hash, err := newPassword(w, r, name)
 	if err != nil {
-		log.Fatal("Can't get entry for user", err)
+		execTemplate(w, r, "error.html", err.Error())
+		return
 	}
-	if "" != tokensUser[2] &&
-		nil != bcrypt.CompareHashAndPassword([]byte(tokensUser[3]),
-			[]byte(r.FormValue("secanswer"))) {
-		execTemplate(w, "error.html", "Wrong answer(s).")
-		removeLineStartingWith(pwResetPath, urlPart)
+	u.hash = hash
+	if err := store.updateUser(u); err != nil {
+		serverError(w, r, err)
 		return
 	}
-	hash, err := newPassword(w, r)
-	if err != nil {
-		execTemplate(w, "error.html", err.Error())
+	if err := store.removePwReset(selector); err != nil {
+		serverError(w, r, err)
 		return
 	}
-	tokensUser[0] = hash
-	line := name + "\t" + strings.Join(tokensUser, "\t")
-	replaceLineStartingWith(loginsPath, tokens[0], line)
-	removeLineStartingWith(pwResetPath, urlPart)
-	execTemplate(w, "feedset.html", "")
+	if err := store.removeSessionsOf(name); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if err := store.removeAccountDelay(name); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	execTemplate(w, r, "feedset.html", "")
 }
 
 func signUpFormHandler(w http.ResponseWriter, r *http.Request) {
 	if !signupOpen {
-		execTemplate(w, "nosignup.html", "")
+		execTemplate(w, r, "nosignup.html", "")
 		return
 	}
-	execTemplate(w, "signupform.html", "")
+	execTemplate(w, r, "signupform.html", "")
 }
 
 func signUpHandler(w http.ResponseWriter, r *http.Request) {
 	if !signupOpen {
-		execTemplate(w, "error.html",
+		execTemplate(w, r, "error.html",
 			"Account creation currently not allowed.")
 		return
 	}
 	name := r.FormValue("name")
 	if !nameIsLegal(name) {
-		execTemplate(w, "error.html", "Illegal name.")
+		execTemplate(w, r, "error.html", "Illegal name.")
 		return
 	}
-	if _, err := getFromFileEntryFor(loginsPath, name, 5); err == nil {
-		execTemplate(w, "error.html", "Username taken.")
+	if _, err := store.getUser(name); err == nil {
+		execTemplate(w, r, "error.html", "Username taken.")
+		return
+	} else if err != errNotFound {
+		serverError(w, r, err)
 		return
 	}
-	hash, err := newPassword(w, r)
+	hash, err := newPassword(w, r, name)
 	if err != nil {
-		execTemplate(w, "error.html", err.Error())
+		execTemplate(w, r, "error.html", err.Error())
 		return
 	}
 	mail := ""
 	if "" != r.FormValue("mail") {
 		mail, err = newMailAddress(w, r)
+		if err == nil && !mailEnabled() {
+			err = errors.New("Mail addresses can't be verified, " +
+				"as this server sends no mails.")
+		}
 		if err != nil {
-			execTemplate(w, "error.html", err.Error())
+			execTemplate(w, r, "error.html", err.Error())
 			return
 		}
 	}
@@ -195,25 +245,128 @@ func signUpHandler(w http.ResponseWriter, r *http.Request) {
 	if "" != r.FormValue("secquestion") || "" != r.FormValue("secanswer") {
 		secquestion, secanswer, err = newSecurityQuestion(w, r)
 		if err != nil {
-			execTemplate(w, "error.html", err.Error())
+			execTemplate(w, r, "error.html", err.Error())
 			return
 		}
 	}
-	appendToFile(loginsPath,
-		name+"\t"+hash+"\t"+mail+"\t"+secquestion+"\t"+secanswer)
-	execTemplate(w, "feedset.html", "")
+	err = store.addUser(user{name: name, hash: hash,
+		secQuestion: secquestion, secAnswer: secanswer})
+	if err == errExists {
+		execTemplate(w, r, "error.html", "Username taken.")
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if "" == mail {
+		execTemplate(w, r, "feedset.html", "")
+		return
+	}
+	if err := requestMailVerification(name, mail); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	execTemplate(w, r, "mailverifysent.html", "")
 }
 
+// accountSetPwHandler also ends the account's sessions other than the one
+// the change is made in, so a password change locks out whoever else may
+// have logged in.
 func accountSetPwHandler(w http.ResponseWriter, r *http.Request) {
-	changeLoginField(w, r, newPassword, 0)
+	name, err := login(w, r, scopeAccount)
+	if err != nil {
+		return
+	}
+	hash, err := newPassword(w, r, name)
+	if err != nil {
+		execTemplate(w, r, "error.html", err.Error())
+		return
+	}
+	u, err := store.getUser(name)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	u.hash = hash
+	if err := store.updateUser(u); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if err := removeOtherSessions(r, name); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	execTemplate(w, r, "feedset.html", "")
 }
 
+// accountSetMailHandler removes the account's mail address if given none, but
+// only sets a new one once it's verified. Removing it also drops pending
+// verifications, lest a link sent earlier set an address again.
 func accountSetMailHandler(w http.ResponseWriter, r *http.Request) {
-	changeLoginField(w, r, newMailAddress, 1)
+	if "" == r.FormValue("mail") {
+		changeLoginField(w, r, func(w http.ResponseWriter,
+			r *http.Request, name string) (string, error) {
+			return "", store.removeMailVerificationsOf(name)
+		}, func(u *user, input string) { u.mail = input })
+		return
+	}
+	name, err := login(w, r, scopeAccount)
+	if err != nil {
+		return
+	}
+	mail, err := newMailAddress(w, r)
+	if err == nil && !mailEnabled() {
+		err = errors.New("Mail addresses can't be verified, as this " +
+			"server sends no mails.")
+	}
+	if err != nil {
+		execTemplate(w, r, "error.html", err.Error())
+		return
+	}
+	if err := requestMailVerification(name, mail); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	execTemplate(w, r, "mailverifysent.html", "")
+}
+
+// mailVerifyHandler sets the address whose verification link was followed
+// as the account's mail address.
+func mailVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	selector, hash := splitLinkSecret(mux.Vars(r)["secret"])
+	name, mail, storedHash, createTime, err :=
+		store.getMailVerification(selector)
+	if err == nil && ("" == hash || 1 != subtle.ConstantTimeCompare(
+		[]byte(hash), []byte(storedHash)) ||
+		createTime+verifyLinkExp < int(time.Now().Unix())) {
+		err = errNotFound
+	}
+	if err == errNotFound {
+		http.Redirect(w, r, "/404", 302)
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	u, err := store.getUser(name)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	u.mail = mail
+	if err := store.updateUser(u); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if err := store.removeMailVerification(selector); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	execTemplate(w, r, "mailverified.html", "")
 }
 
 func accountSetQuestionHandler(w http.ResponseWriter, r *http.Request) {
-	name, err := login(w, r)
+	name, err := login(w, r, scopeAccount)
 	if err != nil {
 		return
 	}
@@ -221,63 +374,336 @@ func accountSetQuestionHandler(w http.ResponseWriter, r *http.Request) {
 	if "" != r.FormValue("secquestion") || "" != r.FormValue("secanswer") {
 		secquestion, secanswer, err = newSecurityQuestion(w, r)
 		if err != nil {
-			execTemplate(w, "error.html", err.Error())
+			execTemplate(w, r, "error.html", err.Error())
 			return
 		}
 	}
-	tokens, err := getFromFileEntryFor(loginsPath, name, 5)
+	u, err := store.getUser(name)
 	if err != nil {
-		log.Fatal("Can't get entry for user", err)
+		serverError(w, r, err)
+		return
+	}
+	u.secQuestion = secquestion
+	u.secAnswer = secanswer
+	if err := store.updateUser(u); err != nil {
+		serverError(w, r, err)
+		return
 	}
-	tokens[2] = secquestion
-	tokens[3] = secanswer
-	replaceLineStartingWith(loginsPath, name,
-		name+"\t"+strings.Join(tokens, "\t"))
-	execTemplate(w, "feedset.html", "")
+	execTemplate(w, r, "feedset.html", "")
 }
 
-func listHandler(w http.ResponseWriter, r *http.Request) {
-	file := openFile(loginsPath)
-	defer file.Close()
-	scanner := bufio.NewScanner(bufio.NewReader(file))
-	var dir []string
-	tokens := tokensFromLine(scanner, 5)
-	for 0 != len(tokens) {
-		dir = append(dir, tokens[0])
-		tokens = tokensFromLine(scanner, 5)
+func accountHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := sessionFromRequest(r)
+	if err != nil && err != errNotFound {
+		serverError(w, r, err)
+		return
 	}
-	type data struct{ Dir []string }
-	err := templ.ExecuteTemplate(w, "list.html", data{Dir: dir})
+	type sessionData struct {
+		ID      string
+		Client  string
+		Created time.Time
+		Expires time.Time
+		Current bool
+	}
+	type data struct {
+		Msg          string
+		Session      string
+		SessionsOpen bool
+		Sessions     []sessionData
+		CSRF         csrfForms
+	}
+	d := data{Session: s.name, SessionsOpen: sessionsOpen,
+		CSRF: csrfFormsFor(w, r)}
+	if "" != s.name {
+		sessions, err := store.sessionsOf(s.name)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		now := int(time.Now().Unix())
+		for _, other := range sessions {
+			if other.expires < now {
+				continue
+			}
+			d.Sessions = append(d.Sessions, sessionData{
+				ID:      other.id,
+				Client:  other.client,
+				Created: time.Unix(int64(other.created), 0),
+				Expires: time.Unix(int64(other.expires), 0),
+				Current: other.id == s.id})
+		}
+	}
+	renderTemplate(w, r, "account.html", d)
+}
+
+func loginFormHandler(w http.ResponseWriter, r *http.Request) {
+	if !sessionsOpen {
+		execTemplate(w, r, "error.html", "Sessions are not enabled.")
+		return
+	}
+	execTemplate(w, r, "login.html", "")
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if !sessionsOpen {
+		execTemplate(w, r, "error.html", "Sessions are not enabled.")
+		return
+	}
+	name, err := checkCredentials(w, r)
+	if err != nil {
+		return
+	}
+	if err := newSession(w, r, name); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/account", 302)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := sessionFromRequest(r)
+	if err == nil {
+		err = store.removeSession(s.id)
+	}
+	if err != nil && err != errNotFound {
+		serverError(w, r, err)
+		return
+	}
+	setSessionCookie(w, "", 0)
+	http.Redirect(w, r, "/", 302)
+}
+
+func sessionRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := login(w, r, scopeAccount)
+	if err != nil {
+		return
+	}
+	s, err := store.getSession(r.FormValue("session"))
+	if err == errNotFound || (err == nil && s.name != name) {
+		execTemplate(w, r, "error.html", "No such session.")
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if err := store.removeSession(s.id); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/account", 302)
+}
+
+func apiTokensHandler(w http.ResponseWriter, r *http.Request) {
+	name := sessionName(r)
+	type tokenData struct {
+		Label   string
+		Scopes  string
+		Created time.Time
+	}
+	type data struct {
+		Msg     string
+		Session string
+		Scopes  []string
+		Tokens  []tokenData
+		CSRF    csrfForms
+	}
+	d := data{Session: name, Scopes: apiScopes, CSRF: csrfFormsFor(w, r)}
+	if "" != name {
+		apiTokens, err := store.apiTokensOf(name)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		for _, t := range apiTokens {
+			scopes := strings.Replace(t.scopes, ",", ", ", -1)
+			d.Tokens = append(d.Tokens, tokenData{Label: t.label,
+				Scopes:  scopes,
+				Created: time.Unix(int64(t.created), 0)})
+		}
+	}
+	renderTemplate(w, r, "apitokens.html", d)
+}
+
+func apiTokenCreateHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := login(w, r, "")
+	if err != nil {
+		return
+	}
+	r.ParseForm()
+	token, err := newAPIToken(name, r.FormValue("label"),
+		r.Form["scope"])
+	if err != nil {
+		execTemplate(w, r, "error.html", err.Error())
+		return
+	}
+	execTemplate(w, r, "apitokencreated.html", token)
+}
+
+func apiTokenRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := login(w, r, "")
+	if err != nil {
+		return
+	}
+	apiTokens, err := store.apiTokensOf(name)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	for _, t := range apiTokens {
+		if r.FormValue("label") == t.label {
+			if err := store.removeAPIToken(t.id); err != nil {
+				serverError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, "/apitokens", 302)
+			return
+		}
+	}
+	execTemplate(w, r, "error.html", "No such API token.")
+}
+
+func twoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	name := sessionName(r)
+	enabled := false
+	if "" != name {
+		_, err := store.getTwoFactor(name)
+		if err != nil && err != errNotFound {
+			serverError(w, r, err)
+			return
+		}
+		enabled = err == nil
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	uri := totpURI(name, secret)
+	qrCode, err := qrDataURI(uri)
 	if err != nil {
-		log.Fatal("Trouble executing template", err)
+		serverError(w, r, err)
+		return
 	}
+	type data struct {
+		Msg     string
+		Session string
+		Enabled bool
+		Secret  string
+		URI     string
+		QR      template.URL
+		CSRF    csrfForms
+	}
+	renderTemplate(w, r, "twofactor.html", data{Session: name,
+		Enabled: enabled, Secret: secret, URI: uri, QR: qrCode,
+		CSRF: csrfFormsFor(w, r)})
+}
+
+func twoFactorEnableHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := login(w, r, "")
+	if err != nil {
+		return
+	}
+	if _, err := store.getTwoFactor(name); err == nil {
+		execTemplate(w, r, "error.html",
+			"Two-factor authentication is already enabled.")
+		return
+	} else if err != errNotFound {
+		serverError(w, r, err)
+		return
+	}
+	secret := r.FormValue("secret")
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || 20 != len(key) {
+		execTemplate(w, r, "error.html", "Illegal TOTP secret.")
+		return
+	}
+	step := totpStep(secret, strings.TrimSpace(r.FormValue("totp_new")), 0)
+	if -1 == step {
+		execTemplate(w, r, "error.html", "Wrong two-factor code.")
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	err = store.setTwoFactor(twoFactor{name: name, secret: secret,
+		lastStep: step, recovery: hashes})
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	type data struct {
+		Msg     string
+		Session string
+		Codes   []string
+	}
+	renderTemplate(w, r, "twofactorenabled.html",
+		data{Session: sessionName(r), Codes: codes})
+}
+
+// twoFactorDisableHandler insists on name, password and a current code even
+// from users logged in by session, lest a stolen session suffice.
+func twoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := checkCredentials(w, r)
+	if err != nil {
+		return
+	}
+	if _, err := store.getTwoFactor(name); err == errNotFound {
+		execTemplate(w, r, "error.html",
+			"Two-factor authentication is not enabled.")
+		return
+	} else if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if err := store.removeTwoFactor(name); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	execTemplate(w, r, "feedset.html", "")
+}
+
+func listHandler(w http.ResponseWriter, r *http.Request) {
+	dir, err := store.userNames()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	type data struct{ Dir []string }
+	renderTemplate(w, r, "list.html", data{Dir: dir})
 }
 
 func twtxtPostHandler(w http.ResponseWriter, r *http.Request) {
-	name, err := login(w, r)
+	name, err := login(w, r, scopePost)
 	if err != nil {
 		return
 	}
 	text := r.FormValue("twt")
-	twtsFile := feedsPath + "/" + name
-	createFileIfNotExists(twtsFile)
 	text = strings.Replace(text, "\n", " ", -1)
-	appendToFile(twtsFile, time.Now().Format(time.RFC3339)+"\t"+text)
+	line := time.Now().Format(time.RFC3339) + "\t" + text
+	if err := store.appendToFeed(name, line); err != nil {
+		serverError(w, r, err)
+		return
+	}
 	http.Redirect(w, r, "/"+feedsDir+"/"+name, 302)
 }
 
 func twtxtHandler(w http.ResponseWriter, r *http.Request) {
 	name := mux.Vars(r)["name"]
 	if !onlyLegalRunes(name) {
-		execTemplate(w, "error.html", "Bad path.")
+		execTemplate(w, r, "error.html", "Bad path.")
 		return
 	}
-	path := feedsPath + "/" + name
-	if _, err := os.Stat(path); err != nil {
-		execTemplate(w, "error.html", "Empty twtxt for user.")
+	feed, modTime, err := store.getFeed(name)
+	if err == errNotFound {
+		execTemplate(w, r, "error.html", "Empty twtxt for user.")
+		return
+	} else if err != nil {
+		serverError(w, r, err)
 		return
 	}
-	http.ServeFile(w, r, path)
+	http.ServeContent(w, r, name, modTime, bytes.NewReader(feed))
 }
 
 func handleRoutes() *mux.Router {
@@ -287,29 +713,48 @@ func handleRoutes() *mux.Router {
 	router.HandleFunc("/feeds/", listHandler)
 	router.HandleFunc("/accountsetquestion",
 		handleTemplate("accountsetquestion.html", "")).Methods("GET")
-	router.HandleFunc("/accountsetquestion", accountSetQuestionHandler).
-		Methods("POST")
+	router.HandleFunc("/accountsetquestion",
+		csrfChecked(accountSetQuestionHandler)).Methods("POST")
 	router.HandleFunc("/accountsetmail",
 		handleTemplate("accountsetmail.html", "")).Methods("GET")
-	router.HandleFunc("/accountsetmail", accountSetMailHandler).
-		Methods("POST")
+	router.HandleFunc("/accountsetmail",
+		csrfChecked(accountSetMailHandler)).Methods("POST")
 	router.HandleFunc("/accountsetpw", handleTemplate("accountsetpw.html",
 		"")).Methods("GET")
-	router.HandleFunc("/accountsetpw", accountSetPwHandler).Methods("POST")
-	router.HandleFunc("/account", handleTemplate("account.html", ""))
+	router.HandleFunc("/accountsetpw", csrfChecked(accountSetPwHandler)).
+		Methods("POST")
+	router.HandleFunc("/account", accountHandler)
+	router.HandleFunc("/login", loginFormHandler).Methods("GET")
+	router.HandleFunc("/login", csrfChecked(loginHandler)).Methods("POST")
+	router.HandleFunc("/logout", csrfChecked(logoutHandler)).Methods("POST")
+	router.HandleFunc("/sessionrevoke", csrfChecked(sessionRevokeHandler)).
+		Methods("POST")
+	router.HandleFunc("/apitokens", apiTokensHandler).Methods("GET")
+	router.HandleFunc("/apitokens", csrfChecked(apiTokenCreateHandler)).
+		Methods("POST")
+	router.HandleFunc("/apitokenrevoke",
+		csrfChecked(apiTokenRevokeHandler)).Methods("POST")
+	router.HandleFunc("/twofactor", twoFactorHandler).Methods("GET")
+	router.HandleFunc("/twofactor", csrfChecked(twoFactorEnableHandler)).
+		Methods("POST")
+	router.HandleFunc("/twofactordisable",
+		csrfChecked(twoFactorDisableHandler)).Methods("POST")
 	router.HandleFunc("/signup", signUpFormHandler).Methods("GET")
-	router.HandleFunc("/signup", signUpHandler).Methods("POST")
-	router.HandleFunc("/feeds", twtxtPostHandler).Methods("POST")
+	router.HandleFunc("/signup", csrfChecked(signUpHandler)).Methods("POST")
+	router.HandleFunc("/feeds", csrfChecked(twtxtPostHandler)).
+		Methods("POST")
 	router.HandleFunc("/feeds/{name}", twtxtHandler)
 	router.HandleFunc("/info", handleTemplate("info.html", contact))
-	router.HandleFunc("/passwordreset", passwordResetRequestPostHandler).
-		Methods("POST")
+	router.HandleFunc("/passwordreset",
+		csrfChecked(passwordResetRequestPostHandler)).Methods("POST")
 	router.HandleFunc("/passwordreset", passwordResetRequestGetHandler).
 		Methods("GET")
 	router.HandleFunc("/passwordreset/{secret}",
 		passwordResetLinkGetHandler).Methods("GET")
+	router.HandleFunc("/verifymail/{secret}", mailVerifyHandler).
+		Methods("GET")
 	router.HandleFunc("/passwordreset/{secret}",
-		passwordResetLinkPostHandler).Methods("POST")
+		csrfChecked(passwordResetLinkPostHandler)).Methods("POST")
 	router.HandleFunc("/style.css",
 		func(w http.ResponseWriter, r *http.Request) {
 			http.ServeFile(w, r, templPath+"/style.css")
@@ -0,0 +1,113 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "golang.org/x/crypto/bcrypt"
+import "html/template"
+import "net/http"
+import "net/http/httptest"
+import "net/url"
+import "runtime"
+import "strconv"
+import "strings"
+import "sync"
+import "testing"
+
+// testServer sets up a fresh data directory with the users names, all with
+// the password "password", and returns the router serving it.
+func testServer(t *testing.T, names ...string) http.Handler {
+	dataDir = t.TempDir()
+	templPath = "templates"
+	initFilesAndDirs()
+	store = newFileStorage()
+	hashScheme = hashBcrypt
+	bcryptCost = bcrypt.MinCost
+	var err error
+	templ, err = template.New("main").ParseGlob(templPath + "/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		hash, err := hashFromPw("password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.addUser(user{name: name, hash: hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return handleRoutes()
+}
+
+func TestConcurrentFeedPosts(t *testing.T) {
+	const nPosts = 200
+	names := []string{"foo", "bar"}
+	router := testServer(t, names...)
+	// Let the requests overlap even on machines with a single core.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	var wg sync.WaitGroup
+	for i := 0; i < nPosts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			form := url.Values{"name": {names[i%len(names)]},
+				"password": {"password"}, "twt": {"twt " +
+					strconv.Itoa(i)},
+				csrfField: {csrfToken("secret", "/feeds")}}
+			r := httptest.NewRequest("POST", "/feeds",
+				strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type",
+				"application/x-www-form-urlencoded")
+			r.AddCookie(&http.Cookie{Name: csrfCookie,
+				Value: "secret"})
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if http.StatusFound != w.Code {
+				t.Errorf("post %d: got status %d: %s", i,
+					w.Code, w.Body.String())
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, name := range names {
+		r := httptest.NewRequest("GET", "/feeds/"+name, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		lines := strings.Split(w.Body.String(), "\n")
+		if n := len(lines) - 1; nPosts/len(names) != n ||
+			"" != lines[n] {
+			t.Errorf("feed %s: got %d lines, want %d", name, n,
+				nPosts/len(names))
+		}
+		for _, line := range lines[:len(lines)-1] {
+			if 2 != len(strings.Split(line, "\t")) {
+				t.Errorf("feed %s: garbled line %q", name,
+					line)
+			}
+		}
+	}
+}
+
+func TestClearMailDropsVerifications(t *testing.T) {
+	router := testServer(t, "foo")
+	err := store.addMailVerification("selector", "hash", "foo", "a@b.c",
+		0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"name": {"foo"}, "password": {"password"},
+		"mail": {""}}
+	r := httptest.NewRequest("POST", "/accountsetmail",
+		strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if http.StatusOK != w.Code {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	_, _, _, _, err = store.getMailVerification("selector")
+	if err != errNotFound {
+		t.Errorf("verification kept: %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "crypto/rand"
+import "crypto/subtle"
+import "encoding/base64"
+import "errors"
+import "fmt"
+import "golang.org/x/crypto/argon2"
+import "golang.org/x/crypto/bcrypt"
+import "strings"
+import "sync"
+
+// Hashes name their scheme and its parameters: bcrypt hashes by their own
+// "$2a$COST$" prefix, argon2id ones in the PHC string format
+// "$argon2id$v=19$m=MEMORY,t=TIME,p=THREADS$SALT$KEY".
+const hashBcrypt = "bcrypt"
+const hashArgon2id = "argon2id"
+
+// Limits to the argon2id parameters, both for hashing by them and for hashes
+// read, lest a corrupted hash make checking a login allocate memory without
+// bound or run next to forever.
+const argon2MaxMemory = 4 * 1024 * 1024
+const argon2MaxTime = 1024
+const argon2MaxKeyLen = 64
+
+// argon2Budget is the memory in KiB that concurrent argon2id hashing may take
+// up together; logins beyond that wait their turn rather than exhaust memory.
+// Each takes a slot as big as argon2Memory, hashes made with more get one
+// anyway.
+const argon2Budget = 512 * 1024
+
+var hashScheme string
+var bcryptCost int
+var argon2Memory uint
+var argon2Time uint
+var argon2Threads uint
+var argon2Slots chan struct{}
+var argon2SlotsOnce sync.Once
+
+type argon2Hash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func checkHashOptions() error {
+	if hashBcrypt == hashScheme {
+		if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("The bcrypt cost must be between "+
+				"%d and %d.", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	} else if hashArgon2id == hashScheme {
+		if 0 == argon2Memory || 0 == argon2Time || 0 == argon2Threads ||
+			argon2Threads > 255 || argon2Memory > argon2MaxMemory ||
+			argon2Time > argon2MaxTime {
+			return fmt.Errorf("The argon2id memory, time and "+
+				"threads must be positive, memory at most %d, "+
+				"time at most %d, threads at most 255.",
+				argon2MaxMemory, argon2MaxTime)
+		}
+	} else {
+		return errors.New("Hash scheme must be " + hashBcrypt + " or " +
+			hashArgon2id + ".")
+	}
+	return nil
+}
+
+// argon2Key runs argon2id hashing once a slot of argon2Budget is free.
+func argon2Key(pw, salt []byte, time, memory uint32, threads uint8,
+	keyLen uint32) []byte {
+	argon2SlotsOnce.Do(func() {
+		n := uint(1)
+		if 0 != argon2Memory && argon2Budget/argon2Memory > 1 {
+			n = argon2Budget / argon2Memory
+		}
+		argon2Slots = make(chan struct{}, n)
+	})
+	argon2Slots <- struct{}{}
+	defer func() { <-argon2Slots }()
+	return argon2.IDKey(pw, salt, time, memory, threads, keyLen)
+}
+
+func parseArgon2Hash(hash string) (argon2Hash, error) {
+	var h argon2Hash
+	var version int
+	tokens := strings.Split(hash, "$")
+	if 6 != len(tokens) || "" != tokens[0] || hashArgon2id != tokens[1] {
+		return h, errors.New("Not an argon2id hash.")
+	}
+	_, err := fmt.Sscanf(tokens[2], "v=%d", &version)
+	if err != nil || argon2.Version != version {
+		return h, errors.New("Unknown argon2id version.")
+	}
+	_, err = fmt.Sscanf(tokens[3], "m=%d,t=%d,p=%d", &h.memory, &h.time,
+		&h.threads)
+	if err != nil {
+		return h, errors.New("Malformed argon2id parameters.")
+	} else if 0 == h.memory || 0 == h.time || 0 == h.threads ||
+		h.memory > argon2MaxMemory || h.time > argon2MaxTime {
+		return h, errors.New("Bad argon2id parameters.")
+	}
+	h.salt, err = base64.RawStdEncoding.DecodeString(tokens[4])
+	if err != nil {
+		return h, errors.New("Malformed argon2id salt.")
+	}
+	h.key, err = base64.RawStdEncoding.DecodeString(tokens[5])
+	if err != nil || 0 == len(h.key) || len(h.key) > argon2MaxKeyLen {
+		return h, errors.New("Malformed argon2id key.")
+	}
+	return h, nil
+}
+
+// hashFromPw hashes pw by the configured scheme.
+func hashFromPw(pw string) (string, error) {
+	if hashArgon2id != hashScheme {
+		hash, err := bcrypt.GenerateFromPassword([]byte(pw), bcryptCost)
+		return string(hash), err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2Key([]byte(pw), salt, uint32(argon2Time),
+		uint32(argon2Memory), uint8(argon2Threads), 32)
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", hashArgon2id,
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// pwMatchesHash checks pw against hash, whatever scheme the latter is of.
+func pwMatchesHash(hash, pw string) bool {
+	if !strings.HasPrefix(hash, "$"+hashArgon2id+"$") {
+		return nil == bcrypt.CompareHashAndPassword([]byte(hash),
+			[]byte(pw))
+	}
+	h, err := parseArgon2Hash(hash)
+	if err != nil {
+		return false
+	}
+	key := argon2Key([]byte(pw), h.salt, h.time, h.memory, h.threads,
+		uint32(len(h.key)))
+	return 1 == subtle.ConstantTimeCompare(key, h.key)
+}
+
+// hashIsOutdated returns whether hash is of another scheme or parameters
+// than hashFromPw would use now.
+func hashIsOutdated(hash string) bool {
+	if hashArgon2id != hashScheme {
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != bcryptCost
+	}
+	h, err := parseArgon2Hash(hash)
+	return err != nil || uint32(argon2Memory) != h.memory ||
+		uint32(argon2Time) != h.time ||
+		uint8(argon2Threads) != h.threads
+}
@@ -0,0 +1,44 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "testing"
+
+func TestParseArgon2Hash(t *testing.T) {
+	const salt = "c2FsdHNhbHRzYWx0c2FsdA"
+	const key = "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	const longKey = "a2tra2tra2tra2tra2tra2tra2tra2tra2tra2tra2tra2tr" +
+		"a2tra2tra2tra2tra2tra2tra2tra2tra2tra2s"
+	tests := []struct {
+		hash string
+		ok   bool
+	}{
+		{"$argon2id$v=19$m=65536,t=1,p=4$" + salt + "$" + key, true},
+		{"$argon2id$v=19$m=4194304,t=1024,p=255$" + salt + "$" + key,
+			true},
+		{"$argon2i$v=19$m=65536,t=1,p=4$" + salt + "$" + key, false},
+		{"$argon2id$v=18$m=65536,t=1,p=4$" + salt + "$" + key, false},
+		{"$argon2id$v=19$m=65536,t=1$" + salt + "$" + key, false},
+		{"$argon2id$v=19$m=0,t=1,p=4$" + salt + "$" + key, false},
+		{"$argon2id$v=19$m=65536,t=0,p=4$" + salt + "$" + key, false},
+		{"$argon2id$v=19$m=65536,t=1,p=0$" + salt + "$" + key, false},
+		{"$argon2id$v=19$m=65536,t=1,p=256$" + salt + "$" + key, false},
+		{"$argon2id$v=19$m=4194305,t=1,p=4$" + salt + "$" + key, false},
+		{"$argon2id$v=19$m=65536,t=1025,p=4$" + salt + "$" + key,
+			false},
+		{"$argon2id$v=19$m=65536,t=1,p=4$" + salt + "$", false},
+		{"$argon2id$v=19$m=65536,t=1,p=4$" + salt + "$" + longKey,
+			false},
+		{"$argon2id$v=19$m=65536,t=1,p=4$!$" + key, false},
+		{"$2a$10$" + salt + key, false},
+	}
+	for _, test := range tests {
+		_, err := parseArgon2Hash(test.hash)
+		if test.ok != (nil == err) {
+			t.Errorf("parseArgon2Hash(%q): %v", test.hash, err)
+		}
+		if !test.ok && pwMatchesHash(test.hash, "") {
+			t.Errorf("pwMatchesHash(%q) matched", test.hash)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "net/http"
+import "strconv"
+
+// The default policy allows for nothing but our own style sheet, forms posting
+// to ourselves and images inlined as data: URIs (the two-factor QR code).
+const defaultCSP = "default-src 'none'; style-src 'self'; " +
+	"img-src 'self' data:; form-action 'self'; frame-ancestors 'none'; " +
+	"base-uri 'none'"
+
+var contentSecurityPolicy string
+var frameOptions string
+var referrerPolicy string
+var hstsMaxAge int
+
+// securityHeaders returns the headers to send with every response; options
+// set to "" (or, for HSTS, to 0) are left out. HSTS is only sent when serving
+// TLS, as browsers ignore it over plain HTTP anyway.
+func securityHeaders() map[string]string {
+	headers := map[string]string{"X-Content-Type-Options": "nosniff"}
+	if "" != contentSecurityPolicy {
+		headers["Content-Security-Policy"] = contentSecurityPolicy
+	}
+	if "" != frameOptions {
+		headers["X-Frame-Options"] = frameOptions
+	}
+	if "" != referrerPolicy {
+		headers["Referrer-Policy"] = referrerPolicy
+	}
+	if "" != keyPath && 0 != hstsMaxAge {
+		headers["Strict-Transport-Security"] = "max-age=" +
+			strconv.Itoa(hstsMaxAge)
+	}
+	return headers
+}
+
+// withSecurityHeaders wraps handler to set securityHeaders on each response.
+func withSecurityHeaders(handler http.Handler) http.Handler {
+	headers := securityHeaders()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range headers {
+			w.Header().Set(name, value)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
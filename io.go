@@ -6,7 +6,10 @@ import "bufio"
 import "errors"
 import "log"
 import "os"
+import "path/filepath"
 import "strings"
+import "sync"
+import "syscall"
 import "io/ioutil"
 
 const loginsFile = "logins.txt"
@@ -14,156 +17,473 @@ const feedsDir = "feeds"
 const ipDelaysFile = "ip_delays.txt"
 const pwResetFile = "password_reset.txt"
 const pwResetWaitFile = "password_reset_wait.txt"
+const sessionsFile = "sessions.txt"
+const apiTokensFile = "api_tokens.txt"
+const twoFactorFile = "two_factor.txt"
+const accountDelaysFile = "account_delays.txt"
+const mailVerifyFile = "mail_verification.txt"
 
+var accountDelaysPath string
+var apiTokensPath string
 var certPath string
 var dataDir string
+var dbPath string
+var deadLettersPath string
 var feedsPath string
 var ipDelaysPath string
 var keyPath string
 var loginsPath string
+var mailQueuePath string
+var mailVerifyPath string
 var pwResetPath string
 var pwResetWaitPath string
+var sessionsPath string
 var templPath string
+var twoFactorPath string
 
-func createFileIfNotExists(path string) {
-	if _, err := os.Stat(path); err != nil {
-		file, err := os.Create(path)
-		if err != nil {
-			log.Fatal("Can't create file: ", err)
-		}
-		file.Close()
+var fileLocks = map[string]*sync.RWMutex{}
+var fileLocksMutex sync.Mutex
+
+// lockFile serializes access to path between goroutines via a mutex and
+// between processes via flock on a hidden lock file next to path. (The lock
+// can't sit on path itself, as writeAtomic replaces it by another file.)
+// Exclusive locks are for writers, shared ones for readers. The returned
+// function releases the lock.
+func lockFile(path string, exclusive bool) (func(), error) {
+	fileLocksMutex.Lock()
+	mutex, ok := fileLocks[path]
+	if !ok {
+		mutex = &sync.RWMutex{}
+		fileLocks[path] = mutex
+	}
+	fileLocksMutex.Unlock()
+	how := syscall.LOCK_SH
+	unlockMutex := mutex.RUnlock
+	if exclusive {
+		how = syscall.LOCK_EX
+		unlockMutex = mutex.Unlock
+		mutex.Lock()
+	} else {
+		mutex.RLock()
+	}
+	lockPath := filepath.Dir(path) + "/." + filepath.Base(path) + "_lock"
+	lock, err := os.OpenFile(lockPath, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		unlockMutex()
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), how); err != nil {
+		lock.Close()
+		unlockMutex()
+		return nil, err
 	}
+	return func() {
+		lock.Close()
+		unlockMutex()
+	}, nil
 }
 
-func openFile(path string) *os.File {
-	file, err := os.Open(path)
+func createFileIfNotExists(path string) error {
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
 	if err != nil {
-		file.Close()
-		log.Fatal("Can't open file for reading", err)
+		return err
 	}
-	return file
+	return file.Close()
 }
 
-func linesFromFile(path string) []string {
+func readLines(path string) ([]string, error) {
 	text, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatal("Can't read file", err)
+		return nil, err
 	}
 	if string(text) == "" {
-		return []string{}
+		return []string{}, nil
+	}
+	return strings.Split(string(text), "\n"), nil
+}
+
+func linesFromFile(path string) ([]string, error) {
+	unlock, err := lockFile(path, false)
+	if err != nil {
+		return nil, err
 	}
-	return strings.Split(string(text), "\n")
+	defer unlock()
+	return readLines(path)
 }
 
-func writeAtomic(path, text string) {
-	tmpFile := path + "_tmp"
-	if err := ioutil.WriteFile(tmpFile, []byte(text), 0600); err != nil {
-		log.Fatal("Trouble writing file", err)
+// writeAtomic expects the caller to hold an exclusive lock on path. It
+// writes text to a hidden temporary file, syncs that, and then renames it over
+// path, so at any time path holds either the old or the new text in full.
+func writeAtomic(path, text string) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path),
+		"."+filepath.Base(path)+"_tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.WriteString(text)
+	if err == nil {
+		err = tmpFile.Sync()
 	}
-	if err := os.Rename(path, path+"_"); err != nil {
-		log.Fatal("Trouble moving file", err)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
 	}
-	if err := os.Rename(tmpFile, path); err != nil {
-		log.Fatal("Trouble moving file", err)
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return err
 	}
-	if err := os.Remove(path + "_"); err != nil {
-		log.Fatal("Trouble removing file", err)
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
 	}
+	defer dir.Close()
+	return dir.Sync()
 }
 
-func writeLinesAtomic(path string, lines []string) {
-	writeAtomic(path, strings.Join(lines, "\n"))
+func writeLinesAtomic(path string, lines []string) error {
+	return writeAtomic(path, strings.Join(lines, "\n"))
 }
 
-func appendToFile(path string, msg string) {
+func appendToFile(path string, msg string) error {
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	text, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatal("Can't read file", err)
+		return err
+	}
+	return writeAtomic(path, string(text)+msg+"\n")
+}
+
+// appendInPlace appends msg as a line to path without rewriting what's
+// already there, and syncs it to disk before returning.
+func appendInPlace(path string, msg string) error {
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.WriteString(msg + "\n"); err != nil {
+		return err
 	}
-	writeAtomic(path, string(text)+msg+"\n")
+	return file.Sync()
 }
 
-func removeLineStartingWith(path, token string) {
-	lines := linesFromFile(path)
-	lineNumber := -1
-	for lineCount := 0; lineCount < len(lines); lineCount += 1 {
-		line := lines[lineCount]
+// appendToFileIfNew appends line unless path already has a line starting
+// with token, and returns whether it did.
+func appendToFileIfNew(path, token, line string) (bool, error) {
+	return appendToFileUnless(path, line, func(tokens []string) bool {
+		return token == tokens[0]
+	})
+}
+
+// appendToFileUnless appends line unless path already has a line whose
+// tab-separated tokens match, and returns whether it did.
+func appendToFileUnless(path, line string,
+	match func(tokens []string) bool) (bool, error) {
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	lines, err := readLines(path)
+	if err != nil {
+		return false, err
+	}
+	for _, old := range lines {
+		if "" != old && match(strings.Split(old, "\t")) {
+			return false, nil
+		}
+	}
+	err = writeAtomic(path, strings.Join(lines, "\n")+line+"\n")
+	return err == nil, err
+}
+
+func findLineStartingWith(lines []string, token string) int {
+	for i, line := range lines {
 		tokens := strings.Split(line, "\t")
 		if 0 == strings.Compare(token, tokens[0]) {
-			lineNumber = lineCount
-			break
+			return i
 		}
 	}
-	lines = append(lines[:lineNumber], lines[lineNumber+1:]...)
-	writeLinesAtomic(path, lines)
+	return -1
 }
 
-func removeLineFromFile(path string, lineNumber int) {
-	lines := linesFromFile(ipDelaysPath)
+func removeLineStartingWith(path, token string) error {
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	lineNumber := findLineStartingWith(lines, token)
+	if -1 == lineNumber {
+		return nil
+	}
 	lines = append(lines[:lineNumber], lines[lineNumber+1:]...)
-	writeLinesAtomic(path, lines)
+	return writeLinesAtomic(path, lines)
 }
 
-func replaceLineStartingWith(path, token, newLine string) {
-	lines := linesFromFile(path)
-	for i, line := range lines {
-		tokens := strings.Split(line, "\t")
-		if 0 == strings.Compare(token, tokens[0]) {
-			lines[i] = newLine
-			break
+func replaceLineStartingWith(path, token, newLine string) error {
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	if i := findLineStartingWith(lines, token); -1 != i {
+		lines[i] = newLine
+		return writeLinesAtomic(path, lines)
+	}
+	return nil
+}
+
+// updateLineStartingWith hands the tokens of the line starting with token to
+// update and, if it returns true, replaces them by what it made of them, all
+// under one lock. It returns whether the line was updated.
+func updateLineStartingWith(path, token string,
+	update func(tokens []string) bool) (bool, error) {
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	lines, err := readLines(path)
+	if err != nil {
+		return false, err
+	}
+	i := findLineStartingWith(lines, token)
+	if -1 == i {
+		return false, nil
+	}
+	tokens := strings.Split(lines[i], "\t")
+	if !update(tokens) {
+		return false, nil
+	}
+	lines[i] = strings.Join(tokens, "\t")
+	return true, writeLinesAtomic(path, lines)
+}
+
+// replaceOrAppendLine replaces the line starting with token by newLine or,
+// if there is no such line, appends newLine.
+func replaceOrAppendLine(path, token, newLine string) error {
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	if i := findLineStartingWith(lines, token); -1 != i {
+		lines[i] = newLine
+		return writeLinesAtomic(path, lines)
+	}
+	return writeAtomic(path, strings.Join(lines, "\n")+newLine+"\n")
+}
+
+// removeLinesWhere removes all lines from path whose tab-separated tokens
+// match.
+func removeLinesWhere(path string, match func(tokens []string) bool) error {
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	var kept []string
+	for _, line := range lines {
+		if "" == line || !match(strings.Split(line, "\t")) {
+			kept = append(kept, line)
 		}
 	}
-	writeLinesAtomic(path, lines)
+	if len(kept) == len(lines) {
+		return nil
+	}
+	return writeLinesAtomic(path, kept)
 }
 
-func tokensFromLine(scanner *bufio.Scanner, nTokensExpected int) []string {
+func tokensFromLine(scanner *bufio.Scanner, nTokensExpected int) ([]string,
+	error) {
 	if !scanner.Scan() {
-		return []string{}
+		return []string{}, scanner.Err()
 	}
 	line := scanner.Text()
 	tokens := strings.Split(line, "\t")
 	if len(tokens) != nTokensExpected {
-		log.Fatal("Line in file had unexpected number of tokens")
+		return nil, errors.New("Line in file had unexpected number " +
+			"of tokens.")
 	}
-	return tokens
+	return tokens, nil
 }
 
+// getFromFileEntryFor returns the tokens following token on the line of path
+// starting with it, or errNotFound if there is no such line.
 func getFromFileEntryFor(path, token string,
 	numberTokensExpected int) ([]string, error) {
-	file := openFile(path)
+	unlock, err := lockFile(path, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
 	defer file.Close()
 	scanner := bufio.NewScanner(bufio.NewReader(file))
-	tokens := tokensFromLine(scanner, numberTokensExpected)
+	tokens, err := tokensFromLine(scanner, numberTokensExpected)
 	for 0 != len(tokens) {
 		if 0 == strings.Compare(tokens[0], token) {
 			return tokens[1:], nil
 		}
-		tokens = tokensFromLine(scanner, numberTokensExpected)
+		tokens, err = tokensFromLine(scanner, numberTokensExpected)
+	}
+	if err != nil {
+		return nil, errors.New(path + ": " + err.Error())
 	}
-	return []string{}, errors.New("")
+	return nil, errNotFound
 }
 
-func initFilesAndDirs() {
-	log.Println("Using as templates dir:", templPath)
-	log.Println("Using as data dir:", dataDir)
+// lineIndex maps the first tokens of a file's lines to the remaining tokens,
+// so lookups need not scan the file. It re-reads the file whenever it finds
+// it changed since the last read.
+type lineIndex struct {
+	path    string
+	nTokens int
+	mutex   sync.Mutex
+	info    os.FileInfo
+	entries map[string][]string
+}
+
+func newLineIndex(path string, nTokens int) *lineIndex {
+	return &lineIndex{path: path, nTokens: nTokens}
+}
+
+func (idx *lineIndex) isCurrent(info os.FileInfo) bool {
+	return idx.info != nil && os.SameFile(idx.info, info) &&
+		idx.info.ModTime().Equal(info.ModTime()) &&
+		idx.info.Size() == info.Size()
+}
+
+// get returns what getFromFileEntryFor would return for idx.path.
+func (idx *lineIndex) get(token string) ([]string, error) {
+	unlock, err := lockFile(idx.path, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	info, err := os.Stat(idx.path)
+	if err != nil {
+		return nil, err
+	}
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	if !idx.isCurrent(info) {
+		lines, err := readLines(idx.path)
+		if err != nil {
+			return nil, err
+		}
+		entries := make(map[string][]string)
+		for _, line := range lines {
+			if "" == line {
+				continue
+			}
+			tokens := strings.Split(line, "\t")
+			if len(tokens) != idx.nTokens {
+				return nil, errors.New(idx.path + ": Line in " +
+					"file had unexpected number of tokens.")
+			}
+			if _, ok := entries[tokens[0]]; !ok {
+				entries[tokens[0]] = tokens[1:]
+			}
+		}
+		idx.entries = entries
+		idx.info = info
+	}
+	tokens, ok := idx.entries[token]
+	if !ok {
+		return nil, errNotFound
+	}
+	return append([]string{}, tokens...), nil
+}
+
+// initPaths sets the paths of the data directory's files, without touching
+// any of them.
+func initPaths() {
 	loginsPath = dataDir + "/" + loginsFile
 	feedsPath = dataDir + "/" + feedsDir
 	ipDelaysPath = dataDir + "/" + ipDelaysFile
 	pwResetPath = dataDir + "/" + pwResetFile
 	pwResetWaitPath = dataDir + "/" + pwResetWaitFile
+	sessionsPath = dataDir + "/" + sessionsFile
+	apiTokensPath = dataDir + "/" + apiTokensFile
+	twoFactorPath = dataDir + "/" + twoFactorFile
+	accountDelaysPath = dataDir + "/" + accountDelaysFile
+	mailVerifyPath = dataDir + "/" + mailVerifyFile
+	mailQueuePath = dataDir + "/" + mailQueueDir
+	deadLettersPath = dataDir + "/" + deadLettersFile
+	versionPath = dataDir + "/" + versionFile
+}
+
+func initFilesAndDirs() {
+	log.Println("Using as templates dir:", templPath)
+	log.Println("Using as data dir:", dataDir)
+	initPaths()
 	if "" != keyPath {
 		log.Println("Using TLS.")
-		if _, err := os.Stat(certPath); err != nil {
-			log.Fatal("No certificate file found.")
+	}
+	version, err := readDataVersion()
+	if err != nil {
+		log.Fatal("Can't read data directory version: ", err)
+	}
+	recoverDataDir(version == schemaVersion || 0 == version)
+	if 0 == version {
+		// Recovery may have restored logins from before versioning.
+		if version, err = readDataVersion(); err != nil {
+			log.Fatal("Can't read data directory version: ", err)
 		}
-		if _, err := os.Stat(keyPath); err != nil {
-			log.Fatal("No server key file found.")
+	}
+	for _, path := range []string{loginsPath, pwResetPath, pwResetWaitPath,
+		ipDelaysPath, sessionsPath, apiTokensPath, twoFactorPath,
+		accountDelaysPath, mailVerifyPath} {
+		if err := createFileIfNotExists(path); err != nil {
+			log.Fatal("Can't create file: ", err)
 		}
 	}
-	createFileIfNotExists(loginsPath)
-	createFileIfNotExists(pwResetPath)
-	createFileIfNotExists(pwResetWaitPath)
-	createFileIfNotExists(ipDelaysPath)
 	// TODO: Handle err here.
 	_ = os.Mkdir(feedsPath, 0700)
+	if err := os.MkdirAll(mailQueuePath, 0700); err != nil {
+		log.Fatal("Can't create mail queue directory: ", err)
+	}
+	if 0 == version {
+		if err := writeDataVersion(schemaVersion); err != nil {
+			log.Fatal("Can't write data directory version: ", err)
+		}
+	}
 }
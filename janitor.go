@@ -0,0 +1,48 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "log"
+import "time"
+
+// delayStaleTime is how long after it has run out a login delay is kept to
+// double on the next failure; after that, the next failure starts anew.
+const delayStaleTime = 3600 * 24
+
+var pruneInterval int
+
+// pruneExpired removes password reset links and waits, sessions, login delays
+// and mail verification links that no longer have any effect.
+func pruneExpired() error {
+	now := int(time.Now().Unix())
+	if err := store.removePwResetsBefore(now - resetLinkExp); err != nil {
+		return err
+	}
+	err := store.removePwResetWaitsBefore(now - resetWaitTime)
+	if err != nil {
+		return err
+	}
+	if err := store.removeIPDelaysBefore(now - delayStaleTime); err != nil {
+		return err
+	}
+	err = store.removeAccountDelaysBefore(now-delayStaleTime,
+		lockoutThreshold)
+	if err != nil {
+		return err
+	}
+	if err := store.removeSessionsBefore(now); err != nil {
+		return err
+	}
+	return store.removeMailVerificationsBefore(now - verifyLinkExp)
+}
+
+// runJanitor calls pruneExpired every pruneInterval seconds, forever.
+func runJanitor() {
+	ticker := time.NewTicker(time.Duration(pruneInterval) * time.Second)
+	for {
+		if err := pruneExpired(); err != nil {
+			log.Println("Can't prune expired data:", err)
+		}
+		<-ticker.C
+	}
+}
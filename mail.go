@@ -0,0 +1,80 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "bytes"
+import "errors"
+import "gopkg.in/gomail.v2"
+import "html/template"
+import "strings"
+import texttemplate "text/template"
+import "time"
+
+// Each mail NAME is rendered from the templates mail/NAME.txt for its plain
+// text part and mail/NAME.html for its HTML part. The first line of the plain
+// text rendering serves as the subject, the rest as the plain text part.
+const mailTemplDir = "mail"
+
+var mailTextTempl *texttemplate.Template
+var mailHTMLTempl *template.Template
+var siteName string
+
+// mailData is what mail templates get to fill in; sendMail sets the fields
+// describing the site, the caller the ones its mail needs.
+type mailData struct {
+	Site     string
+	URL      string
+	Contact  string
+	Name     string
+	Mail     string
+	Link     string
+	Expires  time.Time
+	IP       string
+	Failures int
+	Lockout  int
+}
+
+func loadMailTemplates() error {
+	var err error
+	dir := templPath + "/" + mailTemplDir
+	mailTextTempl, err = texttemplate.ParseGlob(dir + "/*.txt")
+	if err != nil {
+		return err
+	}
+	mailHTMLTempl, err = template.ParseGlob(dir + "/*.html")
+	return err
+}
+
+// sendMail renders the mail name with d and queues it for the mail workers
+// to deliver to the address to.
+func sendMail(to, name string, d mailData) error {
+	d.Site = siteName
+	d.URL = myself
+	d.Contact = contact
+	var text, html bytes.Buffer
+	err := mailTextTempl.ExecuteTemplate(&text, name+".txt", d)
+	if err != nil {
+		return err
+	}
+	err = mailHTMLTempl.ExecuteTemplate(&html, name+".html", d)
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(text.String(), "\n", 2)
+	subject := strings.Replace(strings.TrimSpace(parts[0]), "\t", " ", -1)
+	if 2 != len(parts) || "" == subject {
+		return errors.New("Mail template " + name + ".txt lacks " +
+			"subject line or body.")
+	}
+	m := gomail.NewMessage()
+	m.SetHeader("From", mailFrom())
+	m.SetHeader("To", to)
+	m.SetHeader("Subject", subject)
+	m.SetBody("text/plain", strings.TrimLeft(parts[1], "\n"))
+	m.AddAlternative("text/html", html.String())
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return err
+	}
+	return queueMail(to, subject, buf.Bytes())
+}
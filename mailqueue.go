@@ -0,0 +1,279 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "bytes"
+import "crypto/rand"
+import "encoding/hex"
+import "errors"
+import "gopkg.in/gomail.v2"
+import "io/ioutil"
+import "log"
+import "os"
+import "os/exec"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// Mails are queued as files below mailQueuePath, each holding a line of the
+// tab-separated attempts made so far, time of the next attempt, sender,
+// recipient and subject, followed by the message as it is to be sent. Failed
+// attempts are retried after a delay that doubles each time, up to a day; a
+// mail still failing after mailMaxAttempts attempts is dropped and logged to
+// the dead letter file.
+const mailQueueDir = "mail_queue"
+const deadLettersFile = "mail_dead_letters.txt"
+const mailRetryDelay = 60
+const mailMaxRetryDelay = 3600 * 24
+const mailPollInterval = 10
+const mailPwEnv = "HTWTXT_MAILPW"
+
+var dialer *gomail.Dialer
+var mailFromAddr string
+var mailPwFile string
+var mailuser string
+var mailTestDir string
+var sendmailPath string
+var mailWorkers int
+var mailMaxAttempts int
+var mailWake = make(chan struct{}, 1)
+var mailsInFlight = map[string]bool{}
+var mailsInFlightMutex sync.Mutex
+
+type queuedMail struct {
+	id       string
+	attempts int
+	next     int
+	from     string
+	to       string
+	subject  string
+	message  []byte
+}
+
+// mailEnabled returns whether mails can be sent, be it via an SMTP server, a
+// sendmail program or, in test mode, into mailTestDir.
+func mailEnabled() bool {
+	return "" != mailuser || "" != sendmailPath || "" != mailTestDir
+}
+
+func mailFrom() string {
+	if "" != mailFromAddr {
+		return mailFromAddr
+	} else if "" != mailuser {
+		return mailuser
+	}
+	return "htwtxt@localhost"
+}
+
+func queueMail(to, subject string, message []byte) error {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	now := time.Now()
+	mail := queuedMail{id: strconv.FormatInt(now.UnixNano(), 10) + "-" +
+		hex.EncodeToString(b), next: int(now.Unix()), from: mailFrom(),
+		to: to, subject: subject, message: message}
+	if err := writeQueuedMail(mail); err != nil {
+		return err
+	}
+	select {
+	case mailWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeQueuedMail takes no lock for writeAtomic: a mail's file is only
+// written by queueMail before any worker learns of it and later by the one
+// worker the mail is in flight with, and readers only ever see it renamed
+// into place in full.
+func writeQueuedMail(mail queuedMail) error {
+	return writeAtomic(mailQueuePath+"/"+mail.id, strings.Join([]string{
+		strconv.Itoa(mail.attempts), strconv.Itoa(mail.next),
+		mail.from, mail.to, mail.subject}, "\t")+"\n"+
+		string(mail.message))
+}
+
+func readQueuedMail(id string) (queuedMail, error) {
+	mail := queuedMail{id: id}
+	text, err := ioutil.ReadFile(mailQueuePath + "/" + id)
+	if err != nil {
+		return mail, err
+	}
+	parts := strings.SplitN(string(text), "\n", 2)
+	tokens := strings.Split(parts[0], "\t")
+	if 2 != len(parts) || 5 != len(tokens) {
+		return mail, errors.New("Malformed queued mail " + id + ".")
+	}
+	mail.attempts, err = strconv.Atoi(tokens[0])
+	if err == nil {
+		mail.next, err = strconv.Atoi(tokens[1])
+	}
+	if err != nil {
+		return mail, errors.New("Malformed queued mail " + id + ".")
+	}
+	mail.from, mail.to, mail.subject = tokens[2], tokens[3], tokens[4]
+	mail.message = []byte(parts[1])
+	return mail, nil
+}
+
+// pipeToSendmail delivers mail via the sendmail program, which expects the
+// message with plain newlines rather than the CRLF of SMTP.
+func pipeToSendmail(mail queuedMail) error {
+	cmd := exec.Command(sendmailPath, "-i", "-f", mail.from, "--", mail.to)
+	cmd.Stdin = strings.NewReader(strings.Replace(string(mail.message),
+		"\r\n", "\n", -1))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(sendmailPath + ": " + err.Error() + ": " +
+			strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// deliverMail hands mail to the SMTP server or the sendmail program or, in
+// test mode, writes it into mailTestDir, under its ID, which no other writer
+// uses, so needs no lock.
+func deliverMail(mail queuedMail) error {
+	if "" != mailTestDir {
+		return writeAtomic(mailTestDir+"/"+mail.id+".eml",
+			string(mail.message))
+	} else if "" != sendmailPath {
+		return pipeToSendmail(mail)
+	}
+	s, err := dialer.Dial()
+	if err != nil {
+		return err
+	}
+	err = s.Send(mail.from, []string{mail.to},
+		bytes.NewReader(mail.message))
+	if closeErr := s.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// attemptMail tries to deliver the queued mail id and, should that fail,
+// schedules its next attempt or gives up on it.
+func attemptMail(id string) error {
+	mail, err := readQueuedMail(id)
+	if err != nil {
+		return err
+	}
+	sendErr := deliverMail(mail)
+	if sendErr == nil {
+		return os.Remove(mailQueuePath + "/" + id)
+	}
+	mail.attempts++
+	if mail.attempts >= mailMaxAttempts {
+		log.Println("Giving up on mail", id, "to", mail.to+":", sendErr)
+		line := strings.Join([]string{time.Now().Format(time.RFC3339),
+			mail.id, mail.to, mail.subject,
+			strings.Replace(sendErr.Error(), "\n", " ", -1)}, "\t")
+		if err := appendInPlace(deadLettersPath, line); err != nil {
+			return err
+		}
+		return os.Remove(mailQueuePath + "/" + id)
+	}
+	log.Println("Can't send mail", id, "to", mail.to+":", sendErr)
+	delay := mailMaxRetryDelay
+	if mail.attempts <= 20 {
+		delay = mailRetryDelay << uint(mail.attempts-1)
+		if delay > mailMaxRetryDelay {
+			delay = mailMaxRetryDelay
+		}
+	}
+	mail.next = int(time.Now().Unix()) + delay
+	return writeQueuedMail(mail)
+}
+
+// dueMails returns the queued mails whose next attempt is due and that no
+// worker is busy with yet, marking them as busy.
+func dueMails() ([]string, error) {
+	files, err := ioutil.ReadDir(mailQueuePath)
+	if err != nil {
+		return nil, err
+	}
+	now := int(time.Now().Unix())
+	var ids []string
+	mailsInFlightMutex.Lock()
+	defer mailsInFlightMutex.Unlock()
+	for _, file := range files {
+		id := file.Name()
+		if strings.HasPrefix(id, ".") || mailsInFlight[id] {
+			continue
+		}
+		mail, err := readQueuedMail(id)
+		if err != nil {
+			log.Println("Can't read queued mail:", err)
+			continue
+		} else if mail.next > now {
+			continue
+		}
+		mailsInFlight[id] = true
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func mailWorker(jobs <-chan string) {
+	for id := range jobs {
+		if err := attemptMail(id); err != nil {
+			log.Println("Can't process queued mail:", err)
+		}
+		mailsInFlightMutex.Lock()
+		delete(mailsInFlight, id)
+		mailsInFlightMutex.Unlock()
+	}
+}
+
+// removeQueueLeftovers removes the hidden temporary files of writes to the
+// queue cut short by a crash, so must run before anything is queued anew.
+// The mails they were to queue were never reported as queued, and those they
+// were to update are still queued as they were before.
+func removeQueueLeftovers() error {
+	files, err := ioutil.ReadDir(mailQueuePath)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		i := strings.LastIndex(name, "_tmp")
+		if !strings.HasPrefix(name, ".") || -1 == i ||
+			len(name) == i+4 ||
+			"" != strings.Trim(name[i+4:], "0123456789") {
+			continue
+		}
+		log.Println("Removing leftover of interrupted write:",
+			mailQueuePath+"/"+name)
+		if err := os.Remove(mailQueuePath + "/" + name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runMailQueue hands due mails to mailWorkers workers, looking for them
+// whenever a mail is queued and every mailPollInterval seconds, forever.
+func runMailQueue() {
+	jobs := make(chan string)
+	for i := 0; i < mailWorkers; i++ {
+		go mailWorker(jobs)
+	}
+	ticker := time.NewTicker(mailPollInterval * time.Second)
+	for {
+		ids, err := dueMails()
+		if err != nil {
+			log.Println("Can't read mail queue:", err)
+		}
+		for _, id := range ids {
+			jobs <- id
+		}
+		select {
+		case <-mailWake:
+		case <-ticker.C:
+		}
+	}
+}
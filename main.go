@@ -2,6 +2,7 @@
 
 package main
 
+import "bytes"
 import "errors"
 import "flag"
 import "fmt"
@@ -11,37 +12,97 @@ import "gopkg.in/gomail.v2"
 import "html/template"
 import "io/ioutil"
 import "log"
-import "net"
 import "net/http"
 import "os"
 import "strconv"
 import "strings"
 import "syscall"
 import "time"
+import "unicode/utf8"
 
 const resetLinkExp = 1800
 const resetWaitTime = 3600 * 24
+const verifyLinkExp = 3600 * 24
 const version = "1.0"
 
 var contact string
-var dialer *gomail.Dialer
-var mailuser string
+var lockoutThreshold int
+var notifyThreshold int
+var unlockName string
 var myself string
+var commonPasswords map[string]bool
+var pwListPath string
+var pwMinLength int
 var signupOpen bool
 var templ *template.Template
 
-func execTemplate(w http.ResponseWriter, file string, input string) {
+func logRequestError(r *http.Request, err error) {
+	log.Println(r.Method, r.URL.Path, "from", r.RemoteAddr+":", err)
+}
+
+// serverError logs err with the request during which it occurred and answers
+// that request with a 500 error page.
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	logRequestError(r, err)
 	type data struct{ Msg string }
-	err := templ.ExecuteTemplate(w, file, data{Msg: input})
+	var buf bytes.Buffer
+	err = templ.ExecuteTemplate(&buf, "error.html",
+		data{Msg: "Internal server error."})
 	if err != nil {
-		log.Fatal("Trouble executing template", err)
+		logRequestError(r, err)
+		http.Error(w, "Internal server error.",
+			http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+	buf.WriteTo(w)
+}
+
+// renderTemplate buffers the template's output so that, should executing it
+// fail halfway, the response can still be turned into an error page.
+func renderTemplate(w http.ResponseWriter, r *http.Request, file string,
+	input interface{}) {
+	renderTemplateStatus(w, r, http.StatusOK, file, input)
+}
+
+// renderTemplateStatus is renderTemplate answering with status; as that is
+// only sent once the template is rendered, headers set while rendering, such
+// as cookies for the forms' tokens, still make it into the response.
+func renderTemplateStatus(w http.ResponseWriter, r *http.Request, status int,
+	file string, input interface{}) {
+	var buf bytes.Buffer
+	if err := templ.ExecuteTemplate(&buf, file, input); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// execTemplate renders file with input as its message, with the name of the
+// user logged in by session, if any, so forms can skip asking for it, and with
+// the tokens its forms need.
+func execTemplate(w http.ResponseWriter, r *http.Request, file string,
+	input string) {
+	execTemplateStatus(w, r, http.StatusOK, file, input)
+}
+
+// execTemplateStatus is execTemplate answering with status.
+func execTemplateStatus(w http.ResponseWriter, r *http.Request, status int,
+	file string, input string) {
+	type data struct {
+		Msg     string
+		Session string
+		CSRF    csrfForms
 	}
+	renderTemplateStatus(w, r, status, file, data{Msg: input,
+		Session: sessionName(r), CSRF: csrfFormsFor(w, r)})
 }
 
 func handleTemplate(path, msg string) func(w http.ResponseWriter,
 	r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		execTemplate(w, path, msg)
+		execTemplate(w, r, path, msg)
 	}
 }
 
@@ -56,94 +117,253 @@ func onlyLegalRunes(str string) bool {
 	return true
 }
 
-func checkDelay(w http.ResponseWriter, ip string) (int, error) {
-	var err error
-	var openTime int
+func checkDelay(w http.ResponseWriter, r *http.Request, ip string) (int,
+	error) {
 	delay := -1
-	if tokens, e := getFromFileEntryFor(ipDelaysPath, ip, 3); e == nil {
-		openTime, err = strconv.Atoi(tokens[0])
-		if err != nil {
-			log.Fatal("Can't parse IP delays file", err)
-		}
-		delay, err = strconv.Atoi(tokens[1])
-		if err != nil {
-			log.Fatal("Can't parse IP delays file", err)
-		}
-		if int(time.Now().Unix()) < openTime {
-			execTemplate(w, "error.html",
-				"This IP must wait a while for its "+
-					"next login attempt.")
-			err = errors.New("")
-		}
+	openTime, storedDelay, err := store.getIPDelay(ip)
+	if err == errNotFound {
+		return delay, nil
+	} else if err != nil {
+		serverError(w, r, err)
+		return delay, err
+	}
+	delay = storedDelay
+	if int(time.Now().Unix()) < openTime {
+		execTemplate(w, r, "error.html",
+			"This IP must wait a while for its "+
+				"next login attempt.")
+		return delay, errors.New("")
+	}
+	return delay, nil
+}
+
+// checkAccountDelay is checkDelay for the account name, which is moreover
+// locked for good once lockoutThreshold logins to it in a row failed. It
+// also returns the number of these failures.
+func checkAccountDelay(w http.ResponseWriter, r *http.Request,
+	name string) (int, int, error) {
+	openTime, delay, failures, err := store.getAccountDelay(name)
+	if err == errNotFound {
+		return -1, 0, nil
+	} else if err != nil {
+		serverError(w, r, err)
+		return -1, 0, err
+	}
+	if 0 != lockoutThreshold && failures >= lockoutThreshold {
+		execTemplate(w, r, "error.html", "This account is locked "+
+			"after too many failed logins. Resetting its password "+
+			"unlocks it.")
+		return delay, failures, errors.New("")
+	} else if int(time.Now().Unix()) < openTime {
+		execTemplate(w, r, "error.html",
+			"This account must wait a while for its "+
+				"next login attempt.")
+		return delay, failures, errors.New("")
+	}
+	return delay, failures, nil
+}
+
+// accountLoginFailed delays the next login to u's account and, once
+// notifyThreshold logins in a row failed, tells its owner by mail.
+func accountLoginFailed(r *http.Request, u user, delay, failures int,
+	ip string) error {
+	delay = 2 * delay
+	if -2 == delay {
+		delay = 1
+	}
+	failures++
+	openTime := int(time.Now().Unix()) + delay
+	err := store.setAccountDelay(u.name, openTime, delay, failures)
+	if err != nil {
+		return err
+	}
+	if failures != notifyThreshold || "" == u.mail || !mailEnabled() {
+		return nil
+	}
+	err = sendMail(u.mail, "loginfailures", mailData{Name: u.name,
+		IP: ip, Failures: failures, Lockout: lockoutThreshold})
+	if err != nil {
+		logRequestError(r, err)
 	}
-	return delay, err
+	return nil
 }
 
-func login(w http.ResponseWriter, r *http.Request) (string, error) {
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+// checkCredentials returns the name of the user whose name and password r
+// holds in its HTTP Basic Authorization header or, lacking that, in its form
+// fields, plus, if they enabled two-factor authentication, a current TOTP or
+// recovery code. Failed attempts by either way delay the next ones from the
+// same IP.
+func checkCredentials(w http.ResponseWriter, r *http.Request) (string,
+	error) {
+	ip, err := clientIP(r)
 	if err != nil {
-		log.Fatal("Can't parse ip from request", err)
+		serverError(w, r, err)
+		return "", err
 	}
-	delay, err := checkDelay(w, ip)
+	ipKey := ipDelayKey(ip)
+	delay, err := checkDelay(w, r, ipKey)
 	if err != nil {
 		return "", err
 	}
-	name := r.FormValue("name")
-	pw := r.FormValue("password")
+	name, pw, basicAuth := r.BasicAuth()
+	if !basicAuth {
+		name = r.FormValue("name")
+		pw = r.FormValue("password")
+	}
 	loginValid := false
-	tokens, err := getFromFileEntryFor(loginsPath, name, 5)
-	if err == nil && nil == bcrypt.CompareHashAndPassword([]byte(tokens[0]),
-		[]byte(pw)) {
-		loginValid = true
-		if 0 <= delay {
-			removeLineStartingWith(ipDelaysPath, ip)
+	u, err := store.getUser(name)
+	if err != nil && err != errNotFound {
+		serverError(w, r, err)
+		return "", err
+	}
+	userExists := err == nil
+	accountDelay, failures := -1, 0
+	if userExists {
+		accountDelay, failures, err = checkAccountDelay(w, r, name)
+		if err != nil {
+			return "", err
+		}
+	}
+	if userExists && pwMatchesHash(u.hash, pw) {
+		loginValid, err = checkSecondFactor(name, r.FormValue("totp"))
+		if err != nil {
+			serverError(w, r, err)
+			return "", err
+		}
+	}
+	if loginValid && hashIsOutdated(u.hash) {
+		if err := rehashPassword(u, pw); err != nil {
+			logRequestError(r, err)
+		}
+	}
+	if loginValid && 0 <= delay {
+		if err := store.removeIPDelay(ipKey); err != nil {
+			serverError(w, r, err)
+			return "", err
+		}
+	}
+	if loginValid && 0 <= accountDelay {
+		if err := store.removeAccountDelay(name); err != nil {
+			serverError(w, r, err)
+			return "", err
 		}
 	}
 	if !loginValid {
-		newLine := delay == -1
 		delay = 2 * delay
 		if -2 == delay {
 			delay = 1
 		}
-		strOpenTime := strconv.Itoa(int(time.Now().Unix()) + delay)
-		strDelay := strconv.Itoa(delay)
-		line := ip + "\t" + strOpenTime + "\t" + strDelay
-		if newLine {
-			appendToFile(ipDelaysPath, line)
-		} else {
-			replaceLineStartingWith(ipDelaysPath, ip, line)
+		openTime := int(time.Now().Unix()) + delay
+		err := store.setIPDelay(ipKey, openTime, delay)
+		if err != nil {
+			serverError(w, r, err)
+			return "", err
+		}
+		if userExists {
+			err := accountLoginFailed(r, u, accountDelay, failures,
+				ip)
+			if err != nil {
+				serverError(w, r, err)
+				return "", err
+			}
+		}
+		status := http.StatusOK
+		if basicAuth {
+			w.Header().Set("WWW-Authenticate",
+				`Basic realm="htwtxt", charset="UTF-8"`)
+			status = http.StatusUnauthorized
 		}
-		execTemplate(w, "error_login.html", "Bad login.")
+		execTemplateStatus(w, r, status, "error_login.html",
+			"Bad login.")
 		return name, errors.New("")
 	}
 	return name, nil
 }
 
+// rehashPassword stores pw's hash anew by the current hashing scheme and
+// parameters. The login itself may proceed should this fail.
+func rehashPassword(u user, pw string) error {
+	hash, err := hashFromPw(pw)
+	if err != nil {
+		return err
+	}
+	u.hash = hash
+	return store.updateUser(u)
+}
+
+// login authenticates r by an API token or HTTP Basic credentials in its
+// Authorization header, by its name and password form fields or, if these are
+// absent, by its session cookie. API tokens must grant scope; with scope ""
+// they are refused.
+func login(w http.ResponseWriter, r *http.Request, scope string) (string,
+	error) {
+	if token := bearerToken(r); "" != token {
+		return apiTokenLogin(w, r, token, scope)
+	}
+	if _, _, basicAuth := r.BasicAuth(); basicAuth || !sessionsOpen ||
+		"" != r.FormValue("name") {
+		return checkCredentials(w, r)
+	}
+	s, err := sessionFromRequest(r)
+	if err == errNotFound {
+		execTemplate(w, r, "error_login.html", "Bad login.")
+		return "", err
+	} else if err != nil {
+		serverError(w, r, err)
+		return "", err
+	}
+	return s.name, nil
+}
+
 func nameIsLegal(name string) bool {
 	return !("" == name || !onlyLegalRunes(name) || len(name) > 140)
 }
 
-func passwordIsLegal(password string) bool {
-	return !("" == password)
+// loadCommonPasswords reads the passwords to refuse from the file at
+// pwListPath, one per line.
+func loadCommonPasswords() error {
+	lines, err := readLines(pwListPath)
+	if err != nil {
+		return err
+	}
+	commonPasswords = make(map[string]bool)
+	for _, line := range lines {
+		if pw := strings.TrimSpace(line); "" != pw {
+			commonPasswords[strings.ToLower(pw)] = true
+		}
+	}
+	log.Println("Refusing", len(commonPasswords), "common passwords.")
+	return nil
 }
 
-func hashFromPw(pw string) string {
-	hash, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
-	if err != nil {
-		log.Fatal("Can't generate hash", err)
+// passwordProblem returns why password is not acceptable for the account
+// name by the password policy, or nil if it is.
+func passwordProblem(name, password string) error {
+	if utf8.RuneCountInString(password) < pwMinLength {
+		return errors.New("Password must be at least " +
+			strconv.Itoa(pwMinLength) + " characters long.")
+	} else if strings.EqualFold(name, password) {
+		return errors.New("Password must differ from the name.")
+	} else if commonPasswords[strings.ToLower(password)] {
+		return errors.New("Password is too common, choose another.")
 	}
-	return string(hash)
+	return nil
 }
 
-func newPassword(w http.ResponseWriter, r *http.Request) (string, error) {
+func newPassword(w http.ResponseWriter, r *http.Request, name string) (string,
+	error) {
 	pw := r.FormValue("new_password")
 	pw2 := r.FormValue("new_password2")
 	if 0 != strings.Compare(pw, pw2) {
 		return "", errors.New("Password values did not match")
-	} else if !passwordIsLegal(pw) {
-		return "", errors.New("Illegal password.")
+	} else if err := passwordProblem(name, pw); err != nil {
+		return "", err
 	}
-	return hashFromPw(pw), nil
+	hash, err := hashFromPw(pw)
+	if err != nil {
+		return "", errors.New("Can't hash password: " + err.Error())
+	}
+	return hash, nil
 }
 
 func newMailAddress(w http.ResponseWriter, r *http.Request) (string, error) {
@@ -155,6 +375,24 @@ func newMailAddress(w http.ResponseWriter, r *http.Request) (string, error) {
 	return mail, nil
 }
 
+// requestMailVerification mails a link to mail that, once followed, makes it
+// the mail address of name.
+func requestMailVerification(name, mail string) error {
+	urlPart, err := newLinkSecret()
+	if err != nil {
+		return err
+	}
+	selector, hash := splitLinkSecret(urlPart)
+	now := int(time.Now().Unix())
+	err = store.addMailVerification(selector, hash, name, mail, now)
+	if err != nil {
+		return err
+	}
+	return sendMail(mail, "mailverify", mailData{Name: name, Mail: mail,
+		Link:    myself + "/verifymail/" + urlPart,
+		Expires: time.Unix(int64(now+verifyLinkExp), 0)})
+}
+
 func newSecurityQuestion(w http.ResponseWriter, r *http.Request) (string,
 	string, error) {
 	secquestion := r.FormValue("secquestion")
@@ -166,37 +404,46 @@ func newSecurityQuestion(w http.ResponseWriter, r *http.Request) (string,
 	} else if "" == secanswer {
 		return "", "", errors.New("Illegal security question answer.")
 	}
-	return secquestion, hashFromPw(secanswer), nil
+	hash, err := hashFromPw(secanswer)
+	if err != nil {
+		return "", "", errors.New("Can't hash security question " +
+			"answer: " + err.Error())
+	}
+	return secquestion, hash, nil
 }
 
 func changeLoginField(w http.ResponseWriter, r *http.Request,
-	getter func(w http.ResponseWriter, r *http.Request) (string, error),
-	position int) {
-	name, err := login(w, r)
+	getter func(w http.ResponseWriter, r *http.Request,
+		name string) (string, error),
+	setter func(u *user, input string)) {
+	name, err := login(w, r, scopeAccount)
 	if err != nil {
 		return
 	}
-	input, err := getter(w, r)
+	input, err := getter(w, r, name)
 	if err != nil {
-		execTemplate(w, "error.html", err.Error())
+		execTemplate(w, r, "error.html", err.Error())
 		return
 	}
-	tokens, err := getFromFileEntryFor(loginsPath, name, 5)
+	u, err := store.getUser(name)
 	if err != nil {
-		log.Fatal("Can't get entry for user", err)
+		serverError(w, r, err)
+		return
+	}
+	setter(&u, input)
+	if err := store.updateUser(u); err != nil {
+		serverError(w, r, err)
+		return
 	}
-	tokens[position] = input
-	replaceLineStartingWith(loginsPath, name,
-		name+"\t"+strings.Join(tokens, "\t"))
-	execTemplate(w, "feedset.html", "")
+	execTemplate(w, r, "feedset.html", "")
 }
 
 func nameMyself(ssl bool, port int) string {
 	resp, err := http.Get("http://myexternalip.com/raw")
-	defer resp.Body.Close()
 	if err != nil {
 		log.Fatal("Trouble getting IP", err)
 	}
+	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.Fatal("Trouble reading IP message body", err)
@@ -219,18 +466,44 @@ func addUser(login string) {
 	if !nameIsLegal(name) {
 		log.Fatal("Malformed adduser NAME argument.")
 	}
-	if !passwordIsLegal(password) {
-		log.Fatal("Malformed adduser PASSWORD argument.")
+	if err := passwordProblem(name, password); err != nil {
+		log.Fatal("Malformed adduser PASSWORD argument: ", err)
+	}
+	hash, err := hashFromPw(password)
+	if err != nil {
+		log.Fatal("Can't generate hash", err)
 	}
-	if _, err := getFromFileEntryFor(loginsPath, name, 5); err == nil {
+	err = store.addUser(user{name: name, hash: hash})
+	if err == errExists {
 		log.Fatal("Username already taken.")
+	} else if err != nil {
+		log.Fatal("Can't add user", err)
 	}
-	hash := hashFromPw(password)
-	appendToFile(loginsPath, name+"\t"+hash+"\t\t\t")
 	fmt.Println("Added user.")
 }
 
-func readOptions() (string, int, string, int, string, bool) {
+// readMailPassword reads the SMTP server password from mailPwFile or else the
+// environment variable mailPwEnv, and only lacking both prompts for it.
+func readMailPassword() (string, error) {
+	if "" != mailPwFile {
+		pw, err := ioutil.ReadFile(mailPwFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(pw), "\r\n"), nil
+	}
+	if pw, ok := os.LookupEnv(mailPwEnv); ok {
+		return pw, nil
+	}
+	fmt.Print("Enter password for smtp server: ")
+	bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
+	fmt.Println("")
+	return string(bytePassword), err
+}
+
+func readOptions() (string, int, string, int, string, bool, bool, bool) {
+	var importToDb bool
+	var migrate bool
 	var mailpw string
 	var mailport int
 	var mailserver string
@@ -247,11 +520,74 @@ func readOptions() (string, int, string, int, string, bool) {
 		"directory where to expect HTML templates")
 	flag.StringVar(&dataDir, "dir", os.Getenv("HOME")+"/htwtxt",
 		"directory to store feeds and login data")
+	flag.StringVar(&dbPath, "db", "", "SQLite database file to store "+
+		"login, password reset and IP delay data in instead of text "+
+		"files in the data directory")
+	flag.BoolVar(&importToDb, "dbimport", false, "instead of starting as "+
+		"server, import the data directory's text files into the "+
+		"database given by --db")
+	flag.StringVar(&backupPath, "backup", "", "instead of starting as "+
+		"server, write a backup archive of the data directory (and "+
+		"the database given by --db, if any) to this file")
+	flag.StringVar(&restorePath, "restore", "", "instead of starting as "+
+		"server, restore the data directory (and the database given "+
+		"by --db, if any) from this backup archive file")
+	flag.BoolVar(&migrate, "migrate", false, "instead of starting as "+
+		"server, upgrade the data directory (and the database given "+
+		"by --db, if any) to the current schema version")
 	flag.StringVar(&contact, "contact",
 		"[operator passed no contact info to server]",
 		"operator contact info to display on info page")
+	flag.StringVar(&siteName, "sitename", "hosted twtxt server",
+		"name of the site to sign mails with")
 	flag.BoolVar(&signupOpen, "signup", false,
 		"enable on-site account creation")
+	flag.BoolVar(&sessionsOpen, "sessions", false, "enable logging in "+
+		"via session cookies as an alternative to sending name and "+
+		"password with each request")
+	flag.StringVar(&hashScheme, "hash", hashBcrypt, "scheme to hash "+
+		"passwords and security question answers by: "+hashBcrypt+
+		" or "+hashArgon2id+"; older hashes are upgraded on login")
+	flag.IntVar(&bcryptCost, "bcryptcost", bcrypt.DefaultCost,
+		"cost of bcrypt hashes")
+	flag.UintVar(&argon2Memory, "argon2memory", 64*1024,
+		"memory in KiB used by argon2id hashing")
+	flag.UintVar(&argon2Time, "argon2time", 1,
+		"number of passes of argon2id hashing")
+	flag.UintVar(&argon2Threads, "argon2threads", 4,
+		"number of threads of argon2id hashing")
+	flag.StringVar(&trustedProxiesList, "trusted-proxies", "", "comma-"+
+		"separated IPs or CIDR networks of reverse proxies whose "+
+		"--proxy-header to trust as to the client IP")
+	flag.StringVar(&proxyHeader, "proxy-header", proxyHeaderXFF,
+		"header the trusted proxies list client IPs in: "+
+			proxyHeaderXFF+" or "+proxyHeaderForwarded)
+	flag.IntVar(&ipv6PrefixLen, "ipv6prefix", 64, "length of the IPv6 "+
+		"network prefix whose addresses share login delays")
+	flag.IntVar(&lockoutThreshold, "lockout", 0, "number of failed "+
+		"logins in a row after which to lock an account until its "+
+		"password is reset; 0 to never lock")
+	flag.IntVar(&notifyThreshold, "notifyfailures", 0, "number of failed "+
+		"logins in a row after which to mail the account's owner; 0 "+
+		"to never")
+	flag.StringVar(&unlockName, "unlock", "", "instead of starting as "+
+		"server, clear the login delays and lock of the account NAME")
+	flag.IntVar(&pruneInterval, "pruneinterval", 3600, "seconds between "+
+		"removals of expired password reset links, sessions, login "+
+		"delays and mail verification links; 0 to never remove them")
+	flag.IntVar(&pwMinLength, "pwminlength", 1,
+		"minimum number of characters of new passwords")
+	flag.StringVar(&pwListPath, "pwlist", "", "file listing common or "+
+		"breached passwords, one per line, to refuse as new passwords")
+	flag.StringVar(&contentSecurityPolicy, "csp", defaultCSP,
+		"Content-Security-Policy header to send; empty to send none")
+	flag.StringVar(&frameOptions, "frameoptions", "DENY",
+		"X-Frame-Options header to send; empty to send none")
+	flag.StringVar(&referrerPolicy, "referrerpolicy", "same-origin",
+		"Referrer-Policy header to send; empty to send none")
+	flag.IntVar(&hstsMaxAge, "hstsmaxage", 3600*24*365, "max-age in "+
+		"seconds of the Strict-Transport-Security header sent in TLS "+
+		"mode; 0 to send none")
 	flag.BoolVar(&showVersion, "version", false, "show version number")
 	flag.StringVar(&mailserver, "mailserver", "",
 		"SMTP server to send mails through")
@@ -259,46 +595,198 @@ func readOptions() (string, int, string, int, string, bool) {
 		"port of SMTP server to send mails through")
 	flag.StringVar(&mailuser, "mailuser", "",
 		"username to login with on SMTP server to send mails through")
+	flag.StringVar(&mailPwFile, "mailpwfile", "", "file to read the "+
+		"SMTP server password from instead of the environment "+
+		"variable "+mailPwEnv+" or, lacking that, a prompt")
+	flag.StringVar(&sendmailPath, "sendmail", "", "sendmail-compatible "+
+		"program to pipe mails to instead of sending them via SMTP")
+	flag.StringVar(&mailFromAddr, "mailfrom", "", "sender address of "+
+		"mails; defaults to the SMTP username")
+	flag.StringVar(&mailTestDir, "mailtestdir", "", "directory to write "+
+		"mails into as files instead of sending them via SMTP, for "+
+		"testing")
+	flag.IntVar(&mailWorkers, "mailworkers", 2,
+		"number of mails to send at the same time")
+	flag.IntVar(&mailMaxAttempts, "mailattempts", 8, "number of failed "+
+		"attempts to send a mail after which to give up on it")
+	flag.StringVar(&configPath, "config", "", "file to read options "+
+		"from, as lines of NAME = VALUE or NAME: VALUE with NAME a "+
+		"flag name")
 	flag.Parse()
-	if "" != mailserver && ("" == mailuser || 0 == mailport) {
-		log.Fatal("Mail server usage needs username and port number")
+	problems := applyConfig()
+	problem := func(bad bool, msg string) {
+		if bad {
+			problems = append(problems, msg)
+		}
+	}
+	problem("" != mailserver && ("" == mailuser || 0 == mailport),
+		"Mail server usage needs username and port number.")
+	problem("" != mailserver && "" != sendmailPath,
+		"Expect either mail server or sendmail, not both.")
+	problem(("" == keyPath && "" != certPath) ||
+		("" != keyPath && "" == certPath),
+		"Expect either both key and certificate or none.")
+	if "" != keyPath && "" != certPath {
+		_, err := os.Stat(certPath)
+		problem(err != nil, "No certificate file found.")
+		_, err = os.Stat(keyPath)
+		problem(err != nil, "No server key file found.")
+	}
+	problem("" != backupPath && "" != restorePath,
+		"Expect either backup or restore, not both.")
+	problem(importToDb && "" == dbPath,
+		"Database import needs a database file set by --db.")
+	if err := checkHashOptions(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := parseTrustedProxies(trustedProxiesList); err != nil {
+		problems = append(problems, err.Error())
 	}
-	if ("" == keyPath && "" != certPath) ||
-		("" != keyPath && "" == certPath) {
-		log.Fatal("Expect either both key and certificate or none.")
+	proxyHeader = strings.ToLower(proxyHeader)
+	problem(proxyHeaderXFF != proxyHeader &&
+		proxyHeaderForwarded != proxyHeader, "Proxy header must be "+
+		proxyHeaderXFF+" or "+proxyHeaderForwarded+".")
+	problem(ipv6PrefixLen < 1 || ipv6PrefixLen > 128,
+		"IPv6 prefix length must be between 1 and 128.")
+	problem(lockoutThreshold < 0 || notifyThreshold < 0,
+		"Login failure thresholds must not be negative.")
+	problem(pruneInterval < 0, "Prune interval must not be negative.")
+	problem(pwMinLength < 1,
+		"Minimum password length must be at least 1.")
+	problem(mailWorkers < 1 || mailMaxAttempts < 1,
+		"Mail workers and attempts must be at least 1.")
+	problem(hstsMaxAge < 0, "HSTS max-age must not be negative.")
+	if 0 != len(problems) {
+		log.Fatal("Bad options:\n\t" + strings.Join(problems, "\n\t"))
 	}
 	if "" != mailserver {
-		fmt.Print("Enter password for smtp server: ")
-		bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
-		if err != nil {
-			log.Fatal("Trouble reading password")
+		var err error
+		if mailpw, err = readMailPassword(); err != nil {
+			log.Fatal("Trouble reading password: ", err)
 		}
-		mailpw = string(bytePassword)
-		fmt.Println("")
 	}
-	return mailserver, mailport, mailpw, port, newLogin, showVersion
+	return mailserver, mailport, mailpw, port, newLogin, showVersion,
+		importToDb, migrate
 }
 
 func main() {
 	var err error
-	mailserver, mailport, mailpw, port, newLogin, showVersion :=
-		readOptions()
+	mailserver, mailport, mailpw, port, newLogin, showVersion, importToDb,
+		migrate := readOptions()
 	if showVersion {
 		fmt.Println("htwtxt", version)
 		return
 	}
+	if "" != restorePath {
+		// The data directory may be too damaged to start on, so
+		// neither recover nor create anything in it first.
+		initPaths()
+		if err := restoreBackup(restorePath); err != nil {
+			log.Fatal("Can't restore backup: ", err)
+		}
+		fmt.Println("Restored backup.")
+		return
+	}
 	initFilesAndDirs()
+	var dbStore *sqliteStorage
+	if "" != backupPath {
+		if "" != dbPath {
+			s, err := newSqliteStorage(dbPath)
+			if err != nil {
+				log.Fatal("Can't open database: ", err)
+			}
+			dbStore = &s
+		}
+		if err := writeBackup(backupPath, dbStore); err != nil {
+			log.Fatal("Can't write backup: ", err)
+		}
+		fmt.Println("Wrote backup.")
+		return
+	}
+	if migrate {
+		if err := migrateDataDir(); err != nil {
+			log.Fatal("Can't migrate data directory: ", err)
+		}
+	} else if err := checkDataVersion(); err != nil {
+		log.Fatal(err)
+	}
+	if "" == dbPath {
+		store = newFileStorage()
+	} else {
+		log.Println("Using as database:", dbPath)
+		s, err := newSqliteStorage(dbPath)
+		if err != nil {
+			log.Fatal("Can't open database: ", err)
+		}
+		dbStore = &s
+		if migrate {
+			if err := dbStore.migrate(); err != nil {
+				log.Fatal("Can't migrate database: ", err)
+			}
+		} else if err := dbStore.checkVersion(); err != nil {
+			log.Fatal(err)
+		}
+		if importToDb {
+			if err := dbStore.importTextFiles(); err != nil {
+				log.Fatal("Can't import text files: ", err)
+			}
+			fmt.Println("Imported text files into database.")
+			return
+		}
+		store = dbStore
+	}
+	if migrate {
+		fmt.Println("Migrated to schema version", schemaVersion)
+		return
+	}
+	if "" != pwListPath {
+		if err := loadCommonPasswords(); err != nil {
+			log.Fatal("Can't read password list: ", err)
+		}
+	}
 	if "" != newLogin {
 		addUser(newLogin)
 		return
 	}
+	if "" != unlockName {
+		if err := store.removeAccountDelay(unlockName); err != nil {
+			log.Fatal("Can't unlock account: ", err)
+		}
+		fmt.Println("Unlocked account.")
+		return
+	}
+	if sessionsOpen {
+		if sessionKey, err = loadKey(sessionKeyFile); err != nil {
+			log.Fatal("Can't load session key: ", err)
+		}
+	}
+	if csrfKey, err = loadKey(csrfKeyFile); err != nil {
+		log.Fatal("Can't load form token key: ", err)
+	}
 	myself = nameMyself("" != keyPath, port)
 	templ, err = template.New("main").ParseGlob(templPath + "/*.html")
 	if err != nil {
 		log.Fatal("Can't set up new template: ", err)
 	}
-	http.Handle("/", handleRoutes())
+	if err := loadMailTemplates(); err != nil {
+		log.Fatal("Can't set up mail templates: ", err)
+	}
+	if 0 != pruneInterval {
+		go runJanitor()
+	}
+	http.Handle("/", withSecurityHeaders(handleRoutes()))
 	dialer = gomail.NewPlainDialer(mailserver, mailport, mailuser, mailpw)
+	if "" != mailTestDir {
+		if err := os.MkdirAll(mailTestDir, 0700); err != nil {
+			log.Fatal("Can't create mail test directory: ", err)
+		}
+	}
+	if mailEnabled() {
+		if err := removeQueueLeftovers(); err != nil {
+			log.Fatal("Can't clean up mail queue: ", err)
+		}
+		go runMailQueue()
+	}
 	log.Println("serving at port", port)
 	if "" != keyPath {
 		err = http.ListenAndServeTLS(":"+strconv.Itoa(port),
@@ -0,0 +1,141 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "errors"
+import "net"
+import "net/http"
+import "strconv"
+import "strings"
+
+// Trusted proxies list client addresses in one of these headers; only the one
+// the operator names is read, as proxies pass the others on as the client
+// sent them.
+const proxyHeaderXFF = "x-forwarded-for"
+const proxyHeaderForwarded = "forwarded"
+
+var ipv6PrefixLen int
+var trustedProxies []*net.IPNet
+var trustedProxiesList string
+var proxyHeader string
+
+// parseTrustedProxies reads a comma-separated list of CIDRs or single IPs.
+func parseTrustedProxies(list string) error {
+	trustedProxies = nil
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if "" == entry {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if nil == ip {
+				return errors.New("Bad trusted proxy: " + entry)
+			}
+			bits := 8 * net.IPv6len
+			if nil != ip.To4() {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			entry = ip.String() + "/" + strconv.Itoa(bits)
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return errors.New("Bad trusted proxy: " + entry)
+		}
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+	return nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the client addresses that proxies have listed in r's
+// proxyHeader headers, from the original client to the last proxy before the
+// one r comes from.
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+	if proxyHeaderForwarded != proxyHeader {
+		for _, value := range r.Header["X-Forwarded-For"] {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+		return hops
+	}
+	forwarded := r.Header["Forwarded"]
+	if 0 == len(forwarded) {
+		return hops
+	}
+	for _, element := range strings.Split(strings.Join(forwarded, ","),
+		",") {
+		hop := ""
+		for _, pair := range strings.Split(element, ";") {
+			pair = strings.TrimSpace(pair)
+			tokens := strings.SplitN(pair, "=", 2)
+			if 2 == len(tokens) &&
+				strings.EqualFold("for", tokens[0]) {
+				hop = strings.Trim(tokens[1], `"`)
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// parseHop reads the IP from a forwarding header entry, which may carry a
+// port and, if IPv6, brackets.
+func parseHop(hop string) net.IP {
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
+
+// clientIP returns the IP of the client r originates from. That's the one it
+// comes from unless that is a trusted proxy, in which case the forwarding
+// headers are followed back for as long as they name trusted proxies.
+func clientIP(r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(host)
+	if nil == ip {
+		return "", errors.New("Can't parse remote address " + host)
+	}
+	if !isTrustedProxy(ip) {
+		return ip.String(), nil
+	}
+	hops := forwardedFor(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHop(hops[i])
+		if nil == hop {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return ip.String(), nil
+}
+
+// ipDelayKey returns what to store login delays for ip under: the IP itself
+// if it's IPv4, else the network of the ipv6PrefixLen bits it starts with, as
+// IPv6 users typically hold a whole such network.
+func ipDelayKey(ip string) string {
+	parsed := net.ParseIP(ip)
+	if nil == parsed || nil != parsed.To4() {
+		return ip
+	}
+	mask := net.CIDRMask(ipv6PrefixLen, 8*net.IPv6len)
+	return parsed.Mask(mask).String() + "/" + strconv.Itoa(ipv6PrefixLen)
+}
@@ -0,0 +1,99 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "net/http"
+import "net/http/httptest"
+import "reflect"
+import "testing"
+
+func TestForwardedFor(t *testing.T) {
+	defer func() { proxyHeader = "" }()
+	tests := []struct {
+		proxyHeader string
+		header      http.Header
+		hops        []string
+	}{
+		{proxyHeaderXFF, http.Header{}, nil},
+		{proxyHeaderForwarded, http.Header{}, nil},
+		{proxyHeaderXFF, http.Header{"X-Forwarded-For": {
+			"1.1.1.1, 2.2.2.2", "3.3.3.3"}},
+			[]string{"1.1.1.1", "2.2.2.2", "3.3.3.3"}},
+		{proxyHeaderForwarded, http.Header{"Forwarded": {
+			`for=1.1.1.1;proto=http, For="[2001:db8::1]:80"`,
+			"by=x"}}, []string{"1.1.1.1", "[2001:db8::1]:80", ""}},
+		{proxyHeaderXFF, http.Header{"Forwarded": {"for=1.1.1.1"},
+			"X-Forwarded-For": {"2.2.2.2"}}, []string{"2.2.2.2"}},
+		{proxyHeaderForwarded, http.Header{
+			"Forwarded":       {"for=1.1.1.1"},
+			"X-Forwarded-For": {"2.2.2.2"}}, []string{"1.1.1.1"}},
+		{proxyHeaderXFF, http.Header{"Forwarded": {"for=1.1.1.1"}},
+			nil},
+		{proxyHeaderForwarded, http.Header{
+			"X-Forwarded-For": {"2.2.2.2"}}, nil},
+	}
+	for _, test := range tests {
+		proxyHeader = test.proxyHeader
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header = test.header
+		if hops := forwardedFor(r); !reflect.DeepEqual(test.hops,
+			hops) {
+			t.Errorf("%s %v: got %q, want %q", proxyHeader,
+				test.header, hops, test.hops)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	err := parseTrustedProxies("10.0.0.1, 10.1.0.0/16, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parseTrustedProxies("")
+	defer func() { proxyHeader = "" }()
+	tests := []struct {
+		proxyHeader string
+		remote      string
+		header      http.Header
+		ip          string
+	}{
+		{proxyHeaderXFF, "1.1.1.1:80", http.Header{}, "1.1.1.1"},
+		{proxyHeaderXFF, "1.1.1.1:80", http.Header{
+			"X-Forwarded-For": {"2.2.2.2"}}, "1.1.1.1"},
+		{proxyHeaderXFF, "10.0.0.1:80", http.Header{}, "10.0.0.1"},
+		{proxyHeaderXFF, "10.0.0.1:80", http.Header{
+			"X-Forwarded-For": {"2.2.2.2"}}, "2.2.2.2"},
+		{proxyHeaderXFF, "10.0.0.1:80", http.Header{
+			"X-Forwarded-For": {"3.3.3.3, 2.2.2.2, 10.1.2.3"}},
+			"2.2.2.2"},
+		{proxyHeaderXFF, "10.0.0.1:80", http.Header{
+			"X-Forwarded-For": {"2.2.2.2, junk, 10.1.2.3"}},
+			"10.1.2.3"},
+		{proxyHeaderXFF, "10.0.0.1:80", http.Header{
+			"Forwarded":       {"for=6.6.6.6"},
+			"X-Forwarded-For": {"203.0.113.9"}}, "203.0.113.9"},
+		{proxyHeaderForwarded, "10.0.0.1:80", http.Header{
+			"Forwarded":       {"for=203.0.113.9"},
+			"X-Forwarded-For": {"6.6.6.6"}}, "203.0.113.9"},
+		{proxyHeaderForwarded, "[::1]:80", http.Header{"Forwarded": {
+			`for="[2001:db8::1]:443"`}}, "2001:db8::1"},
+		{proxyHeaderForwarded, "[::1]:80", http.Header{"Forwarded": {
+			"for=_hidden"}}, "::1"},
+	}
+	for _, test := range tests {
+		proxyHeader = test.proxyHeader
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		r.Header = test.header
+		ip, err := clientIP(r)
+		if err != nil || test.ip != ip {
+			t.Errorf("%s %s %v: got %s, %v, want %s", proxyHeader,
+				test.remote, test.header, ip, err, test.ip)
+		}
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "no address"
+	if _, err := clientIP(r); err == nil {
+		t.Error("unparsable remote address accepted")
+	}
+}
@@ -0,0 +1,188 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "errors"
+import "io/ioutil"
+import "log"
+import "os"
+import "path/filepath"
+import "strings"
+
+// leftoversOf lists what interrupted writes to path may have left behind:
+// hidden temporary files of the current writeAtomic and, if legacy is set,
+// the PATH_ backup and PATH_tmp files of versions before it.
+func leftoversOf(path string, legacy bool) []string {
+	var leftovers []string
+	if legacy {
+		for _, leftover := range []string{path + "_", path + "_tmp"} {
+			if _, err := os.Stat(leftover); err == nil {
+				leftovers = append(leftovers, leftover)
+			}
+		}
+	}
+	// ioutil.TempFile only appends digits to the prefix; anything else
+	// may belong to a feed named, say, "foo_tmp_bar" rather than "foo".
+	prefix := filepath.Dir(path) + "/." + filepath.Base(path) + "_tmp"
+	hidden, _ := filepath.Glob(prefix + "*")
+	for _, candidate := range hidden {
+		suffix := strings.TrimPrefix(candidate, prefix)
+		if "" != suffix && "" == strings.Trim(suffix, "0123456789") {
+			leftovers = append(leftovers, candidate)
+		}
+	}
+	return leftovers
+}
+
+// countCompleteLines returns the number of lines in path and whether all of
+// them are complete, i.e. newline-terminated and, unless nTokens is 0, made
+// of nTokens tab-separated tokens.
+func countCompleteLines(path string, nTokens int) (int, bool) {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	if 0 == len(text) {
+		return 0, true
+	}
+	lines := strings.Split(string(text), "\n")
+	if "" != lines[len(lines)-1] {
+		return 0, false
+	}
+	lines = lines[:len(lines)-1]
+	for _, line := range lines {
+		if 0 != nTokens && len(strings.Split(line, "\t")) != nTokens {
+			return 0, false
+		}
+	}
+	return len(lines), true
+}
+
+// recoverFile cleans up after writes to path that were interrupted by a
+// crash. If path exists it is what the last completed write left, so any
+// leftovers are removed. Otherwise path is restored from the leftover that
+// holds the most complete lines, as that's either the last version before
+// the crash or the one it was about to be replaced with.
+func recoverFile(path string, nTokens int, legacy bool) error {
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	leftovers := leftoversOf(path, legacy)
+	if _, err := os.Stat(path); err == nil {
+		if _, ok := countCompleteLines(path, nTokens); !ok &&
+			0 != nTokens {
+			return errors.New(path + " is malformed.")
+		}
+		for _, leftover := range leftovers {
+			log.Println("Removing leftover of interrupted write:",
+				leftover)
+			if err := os.Remove(leftover); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if 0 == len(leftovers) {
+		return nil
+	}
+	best := ""
+	bestCount := -1
+	for _, leftover := range leftovers {
+		count, ok := countCompleteLines(leftover, nTokens)
+		if ok && count >= bestCount {
+			best = leftover
+			bestCount = count
+		}
+	}
+	if "" == best {
+		return errors.New(path + " is missing and none of its " +
+			"leftovers are intact: " +
+			strings.Join(leftovers, ", "))
+	}
+	log.Println("Restoring", path, "from leftover of interrupted write:",
+		best)
+	if err := os.Rename(best, path); err != nil {
+		return err
+	}
+	for _, leftover := range leftovers {
+		if leftover == best {
+			continue
+		}
+		log.Println("Removing leftover of interrupted write:", leftover)
+		if err := os.Remove(leftover); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasFeeds() bool {
+	files, _ := ioutil.ReadDir(feedsPath)
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// recoverDataDir runs recoverFile on the data files and feeds and refuses to
+// start on anything it can't make sense of, such as feeds without logins.
+// Unless current is set, the data files are of another schema version than
+// the one this code knows, so only the completeness of their lines counts.
+func recoverDataDir(current bool) {
+	files := []struct {
+		path    string
+		nTokens int
+	}{{loginsPath, nLoginTokens}, {pwResetPath, 4}, {pwResetWaitPath, 2},
+		{ipDelaysPath, 3}, {sessionsPath, 5}, {apiTokensPath, 5},
+		{twoFactorPath, 4}, {accountDelaysPath, 4}, {mailVerifyPath, 5}}
+	for _, file := range files {
+		nTokens := file.nTokens
+		if !current {
+			nTokens = 0
+		}
+		err := recoverFile(file.path, nTokens, true)
+		if err != nil {
+			log.Fatal("Inconsistent data directory: ", err)
+		}
+	}
+	if _, err := os.Stat(loginsPath); err != nil {
+		if hasFeeds() {
+			log.Fatal("Inconsistent data directory: feeds, but " +
+				"no " + loginsFile + ", refusing to start.")
+		}
+		// A versioned data directory has had its logins file
+		// created, so starting anew would silently drop accounts.
+		if _, err := os.Stat(versionPath); err == nil {
+			log.Fatal("Inconsistent data directory: " +
+				versionFile + ", but no " + loginsFile +
+				", refusing to start.")
+		}
+		return
+	}
+	lines, err := linesFromFile(loginsPath)
+	if err != nil {
+		log.Fatal("Can't read logins: ", err)
+	}
+	isName := make(map[string]bool)
+	var names []string
+	for _, line := range lines {
+		if "" != line {
+			name := strings.Split(line, "\t")[0]
+			isName[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		// Legacy leftovers of feed "foo" are indistinguishable from
+		// the feeds of users "foo_" or "foo_tmp"; leave them be then.
+		legacy := !isName[name+"_"] && !isName[name+"_tmp"]
+		err := recoverFile(feedsPath+"/"+name, 0, legacy)
+		if err != nil {
+			log.Fatal("Inconsistent data directory: ", err)
+		}
+	}
+}
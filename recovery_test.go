@@ -0,0 +1,74 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "io/ioutil"
+import "reflect"
+import "strings"
+import "testing"
+
+func TestRecoverFile(t *testing.T) {
+	const complete = "a\tb\nc\td\n"
+	tests := []struct {
+		files   map[string]string
+		legacy  bool
+		wantErr bool
+		want    map[string]string
+	}{
+		{map[string]string{}, true, false, map[string]string{}},
+		{map[string]string{"f": complete, ".f_tmp123": "a\tb\n",
+			"f_": "a\tb\n", "f_tmp": "a\tb\n"}, true, false,
+			map[string]string{"f": complete}},
+		{map[string]string{"f": complete, "f_": "a\tb\n"}, false,
+			false, map[string]string{"f": complete,
+				"f_": "a\tb\n"}},
+		{map[string]string{"f": "a\tb\nc\n"}, true, true,
+			map[string]string{"f": "a\tb\nc\n"}},
+		{map[string]string{".f_tmp123": complete}, true, false,
+			map[string]string{"f": complete}},
+		{map[string]string{".f_tmp1": complete, ".f_tmp2": "a\tb\n",
+			".f_tmp3": complete + "e\tf"}, true, false,
+			map[string]string{"f": complete}},
+		{map[string]string{"f_": "a\tb\n", "f_tmp": complete}, true,
+			false, map[string]string{"f": complete}},
+		{map[string]string{"f_": complete}, false, false,
+			map[string]string{"f_": complete}},
+		{map[string]string{".f_tmp_g": complete}, true, false,
+			map[string]string{".f_tmp_g": complete}},
+		{map[string]string{".f_tmp1": "a\n", ".f_tmp2": "a\tb"}, true,
+			true, map[string]string{".f_tmp1": "a\n",
+				".f_tmp2": "a\tb"}},
+	}
+	for i, test := range tests {
+		dir := t.TempDir()
+		for name, content := range test.files {
+			err := ioutil.WriteFile(dir+"/"+name, []byte(content),
+				0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := recoverFile(dir+"/f", 2, test.legacy)
+		if test.wantErr != (err != nil) {
+			t.Errorf("case %d: got error %v", i, err)
+		}
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), "_lock") {
+				continue
+			}
+			content, err := ioutil.ReadFile(dir + "/" + file.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[file.Name()] = string(content)
+		}
+		if !reflect.DeepEqual(test.want, got) {
+			t.Errorf("case %d: got %q, want %q", i, got, test.want)
+		}
+	}
+}
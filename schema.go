@@ -0,0 +1,185 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "database/sql"
+import "errors"
+import "io/ioutil"
+import "log"
+import "os"
+import "strconv"
+import "strings"
+
+// schemaVersion is the layout of data directory and database this code
+// expects. Changing the layout means incrementing it and appending a step to
+// migrations that upgrades the previous layout to the new one.
+const schemaVersion = 2
+
+const versionFile = "version"
+
+var versionPath string
+
+// nLoginTokens is the number of tab-separated fields of a logins file line.
+const nLoginTokens = 5
+
+// migration upgrades the data directory's text files and / or the database
+// by one schema version. Either function may be nil if there's nothing to
+// do for its side.
+type migration struct {
+	description string
+	files       func() error
+	db          func(tx *sql.Tx) error
+}
+
+// migrations[i] upgrades schema version i+1 to i+2.
+var migrations = []migration{
+	{"store password reset links hashed; pending ones are dropped",
+		func() error {
+			unlock, err := lockFile(pwResetPath, true)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+			return writeAtomic(pwResetPath, "")
+		},
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec(`DROP TABLE password_reset`)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`CREATE TABLE password_reset (
+				selector TEXT PRIMARY KEY,
+				name TEXT NOT NULL,
+				create_time INTEGER NOT NULL,
+				hash TEXT NOT NULL)`)
+			return err
+		}}}
+
+// readDataVersion returns the data directory's schema version, or 0 if it
+// holds no data yet. Data directories from before versioning have no version
+// file, but do have a logins file, so are version 1.
+func readDataVersion() (int, error) {
+	text, err := ioutil.ReadFile(versionPath)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(loginsPath); err == nil {
+			return 1, nil
+		}
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(text)))
+	if err != nil {
+		return 0, errors.New("Can't parse " + versionPath + ".")
+	}
+	return version, nil
+}
+
+func writeDataVersion(version int) error {
+	unlock, err := lockFile(versionPath, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeAtomic(versionPath, strconv.Itoa(version)+"\n")
+}
+
+func versionMismatch(what string, version int) error {
+	if version < schemaVersion {
+		return errors.New(what + " has schema version " +
+			strconv.Itoa(version) + ", but " +
+			strconv.Itoa(schemaVersion) + " is needed; " +
+			"upgrade it by running with --migrate.")
+	}
+	return errors.New(what + " has schema version " +
+		strconv.Itoa(version) + ", newer than the " +
+		strconv.Itoa(schemaVersion) + " this htwtxt understands.")
+}
+
+func checkDataVersion() error {
+	version, err := readDataVersion()
+	if err != nil {
+		return err
+	} else if version != schemaVersion {
+		return versionMismatch("Data directory", version)
+	}
+	return nil
+}
+
+// migrateDataDir upgrades the data directory's text files step by step,
+// recording each completed step in the version file so an interrupted
+// migration can be resumed.
+func migrateDataDir() error {
+	version, err := readDataVersion()
+	if err != nil {
+		return err
+	} else if version > schemaVersion {
+		return versionMismatch("Data directory", version)
+	}
+	for ; version < schemaVersion; version++ {
+		step := migrations[version-1]
+		log.Println("Migrating data directory to schema version",
+			version+1, "–", step.description)
+		if nil != step.files {
+			if err := step.files(); err != nil {
+				return err
+			}
+		}
+		if err := writeDataVersion(version + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s sqliteStorage) version() (int, error) {
+	var version int
+	err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version)
+	return version, err
+}
+
+func (s sqliteStorage) checkVersion() error {
+	version, err := s.version()
+	if err != nil {
+		return err
+	} else if version != schemaVersion {
+		return versionMismatch("Database", version)
+	}
+	return nil
+}
+
+// migrate upgrades the database step by step, each in a transaction of its
+// own that also records the new version.
+func (s sqliteStorage) migrate() error {
+	version, err := s.version()
+	if err != nil {
+		return err
+	} else if version > schemaVersion {
+		return versionMismatch("Database", version)
+	}
+	for ; version < schemaVersion; version++ {
+		step := migrations[version-1]
+		log.Println("Migrating database to schema version", version+1,
+			"–", step.description)
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if nil != step.db {
+			if err := step.db(tx); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		_, err = tx.Exec(`PRAGMA user_version = ` +
+			strconv.Itoa(version+1))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
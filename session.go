@@ -0,0 +1,180 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/base64"
+import "encoding/hex"
+import "errors"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "strings"
+import "time"
+
+const sessionCookie = "session"
+const sessionExp = 3600 * 24 * 30
+const sessionKeyFile = "session_key"
+
+var sessionKey []byte
+var sessionsOpen bool
+
+// loadKey reads the 32-byte key stored as file in the data directory,
+// generating it on first use.
+func loadKey(file string) ([]byte, error) {
+	path := dataDir + "/" + file
+	key, err := ioutil.ReadFile(path)
+	if err == nil {
+		if 32 != len(key) {
+			return nil, errors.New("Malformed " + path + ".")
+		}
+		return key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(key)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func signSessionSecret(secret string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(secret))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sessionID is what sessions are stored under, so that a leak of the stored
+// data does not leak usable cookies.
+func sessionID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// clientOf describes the client that made r for listing its session.
+func clientOf(r *http.Request) string {
+	client := strings.Map(func(ru rune) rune {
+		if '\t' == ru || '\n' == ru || '\r' == ru {
+			return ' '
+		}
+		return ru
+	}, r.UserAgent())
+	if runes := []rune(client); len(runes) > 140 {
+		client = string(runes[:140])
+	}
+	if "" == client {
+		client = "unknown client"
+	}
+	return client
+}
+
+func setSessionCookie(w http.ResponseWriter, value string, expires int) {
+	cookie := &http.Cookie{Name: sessionCookie, Value: value, Path: "/",
+		HttpOnly: true, Secure: "" != keyPath,
+		SameSite: http.SameSiteStrictMode}
+	if 0 == expires {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Expires = time.Unix(int64(expires), 0)
+	}
+	http.SetCookie(w, cookie)
+}
+
+// newSession stores a new session for name and hands its cookie to the
+// client.
+func newSession(w http.ResponseWriter, r *http.Request, name string) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	now := int(time.Now().Unix())
+	s := session{id: sessionID(secret), name: name, created: now,
+		expires: now + sessionExp, client: clientOf(r)}
+	if err := store.addSession(s); err != nil {
+		return err
+	}
+	setSessionCookie(w, secret+"."+signSessionSecret(secret), s.expires)
+	return nil
+}
+
+// sessionFromRequest returns the session whose cookie r carries, or
+// errNotFound if it carries none that is correctly signed and unexpired.
+func sessionFromRequest(r *http.Request) (session, error) {
+	if !sessionsOpen {
+		return session{}, errNotFound
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return session{}, errNotFound
+	}
+	tokens := strings.Split(cookie.Value, ".")
+	if 2 != len(tokens) || !hmac.Equal([]byte(tokens[1]),
+		[]byte(signSessionSecret(tokens[0]))) {
+		return session{}, errNotFound
+	}
+	s, err := store.getSession(sessionID(tokens[0]))
+	if err != nil {
+		return session{}, err
+	}
+	if s.expires < int(time.Now().Unix()) {
+		if err := store.removeSession(s.id); err != nil {
+			return session{}, err
+		}
+		return session{}, errNotFound
+	}
+	return s, nil
+}
+
+// removeOtherSessions ends all of name's sessions except the one r was made
+// in, if any.
+func removeOtherSessions(r *http.Request, name string) error {
+	current, err := sessionFromRequest(r)
+	if err != nil && err != errNotFound {
+		return err
+	}
+	sessions, err := store.sessionsOf(name)
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if s.id == current.id {
+			continue
+		}
+		err := store.removeSession(s.id)
+		if err != nil && err != errNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// sessionName returns the name of the user logged in by r's session cookie,
+// or "" if there is none.
+func sessionName(r *http.Request) string {
+	s, err := sessionFromRequest(r)
+	if err != nil {
+		if err != errNotFound {
+			logRequestError(r, err)
+		}
+		return ""
+	}
+	return s.name
+}
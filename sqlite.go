@@ -0,0 +1,573 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "database/sql"
+import "errors"
+import _ "github.com/mattn/go-sqlite3"
+import "strconv"
+import "strings"
+import "time"
+
+// sqliteSchema sets up the tables of a database of the current schemaVersion.
+// It runs on every start, also on databases yet to be migrated, so migrations
+// must not expect tables it creates to be missing.
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS logins (
+		name TEXT PRIMARY KEY,
+		hash TEXT NOT NULL,
+		mail TEXT NOT NULL,
+		secquestion TEXT NOT NULL,
+		secanswer TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS password_reset (
+		selector TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		create_time INTEGER NOT NULL,
+		hash TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS password_reset_wait (
+		name TEXT PRIMARY KEY,
+		last_time INTEGER NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS ip_delays (
+		ip TEXT PRIMARY KEY,
+		open_time INTEGER NOT NULL,
+		delay INTEGER NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS account_delays (
+		name TEXT PRIMARY KEY,
+		open_time INTEGER NOT NULL,
+		delay INTEGER NOT NULL,
+		failures INTEGER NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		expires INTEGER NOT NULL,
+		client TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS api_tokens (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		label TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		UNIQUE (name, label))`,
+	`CREATE TABLE IF NOT EXISTS two_factor (
+		name TEXT PRIMARY KEY,
+		secret TEXT NOT NULL,
+		last_step INTEGER NOT NULL,
+		recovery TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS mail_verification (
+		selector TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		mail TEXT NOT NULL,
+		create_time INTEGER NOT NULL,
+		hash TEXT NOT NULL)`}
+
+// sqliteStorage keeps logins, password reset data and IP delays in an SQLite
+// database; feeds stay plain files below dataDir.
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+func newSqliteStorage(path string) (sqliteStorage, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return sqliteStorage{}, err
+	}
+	// SQLite allows only one writer at a time anyway; a single connection
+	// spares us "database is locked" errors under concurrent requests.
+	db.SetMaxOpenConns(1)
+	var nTables int
+	err = db.QueryRow(`SELECT count(*) FROM sqlite_master
+		WHERE type = 'table'`).Scan(&nTables)
+	if err != nil {
+		db.Close()
+		return sqliteStorage{}, err
+	}
+	s := sqliteStorage{db: db}
+	version, err := s.version()
+	if err != nil {
+		db.Close()
+		return sqliteStorage{}, err
+	}
+	// Databases from before schema versioning have tables, but no version.
+	if 0 == nTables {
+		version = schemaVersion
+	} else if 0 == version {
+		version = 1
+	}
+	statements := append(sqliteSchema,
+		`PRAGMA user_version = `+strconv.Itoa(version))
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return sqliteStorage{}, err
+		}
+	}
+	return s, nil
+}
+
+func (s sqliteStorage) getUser(name string) (user, error) {
+	u := user{name: name}
+	err := s.db.QueryRow(`SELECT hash, mail, secquestion, secanswer
+		FROM logins WHERE name = ?`, name).Scan(&u.hash, &u.mail,
+		&u.secQuestion, &u.secAnswer)
+	if err == sql.ErrNoRows {
+		return user{}, errNotFound
+	}
+	return u, err
+}
+
+func (s sqliteStorage) addUser(u user) error {
+	result, err := s.db.Exec(`INSERT OR IGNORE INTO logins
+		(name, hash, mail, secquestion, secanswer)
+		VALUES (?, ?, ?, ?, ?)`,
+		u.name, u.hash, u.mail, u.secQuestion, u.secAnswer)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if 0 == n {
+		return errExists
+	}
+	return nil
+}
+
+func (s sqliteStorage) updateUser(u user) error {
+	_, err := s.db.Exec(`UPDATE logins
+		SET hash = ?, mail = ?, secquestion = ?, secanswer = ?
+		WHERE name = ?`,
+		u.hash, u.mail, u.secQuestion, u.secAnswer, u.name)
+	return err
+}
+
+func (s sqliteStorage) userNames() ([]string, error) {
+	rows, err := s.db.Query(`SELECT name FROM logins ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (sqliteStorage) appendToFeed(name, line string) error {
+	return appendToFeedFile(name, line)
+}
+
+func (sqliteStorage) getFeed(name string) ([]byte, time.Time, error) {
+	return readFeedFile(name)
+}
+
+func (s sqliteStorage) addPwReset(selector, hash, name string,
+	createTime int) error {
+	_, err := s.db.Exec(`INSERT INTO password_reset
+		(selector, name, create_time, hash) VALUES (?, ?, ?, ?)`,
+		selector, name, createTime, hash)
+	return err
+}
+
+func (s sqliteStorage) getPwReset(selector string) (string, string, int,
+	error) {
+	var name, hash string
+	var createTime int
+	err := s.db.QueryRow(`SELECT name, hash, create_time
+		FROM password_reset WHERE selector = ?`, selector).Scan(&name,
+		&hash, &createTime)
+	if err == sql.ErrNoRows {
+		return "", "", 0, errNotFound
+	}
+	return name, hash, createTime, err
+}
+
+func (s sqliteStorage) removePwReset(selector string) error {
+	_, err := s.db.Exec(`DELETE FROM password_reset WHERE selector = ?`,
+		selector)
+	return err
+}
+
+func (s sqliteStorage) getPwResetWait(name string) (int, error) {
+	var lastTime int
+	err := s.db.QueryRow(`SELECT last_time FROM password_reset_wait
+		WHERE name = ?`, name).Scan(&lastTime)
+	if err == sql.ErrNoRows {
+		return 0, errNotFound
+	}
+	return lastTime, err
+}
+
+func (s sqliteStorage) setPwResetWait(name string, lastTime int) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO password_reset_wait
+		(name, last_time) VALUES (?, ?)`, name, lastTime)
+	return err
+}
+
+func (s sqliteStorage) getIPDelay(ip string) (int, int, error) {
+	var openTime, delay int
+	err := s.db.QueryRow(`SELECT open_time, delay FROM ip_delays
+		WHERE ip = ?`, ip).Scan(&openTime, &delay)
+	if err == sql.ErrNoRows {
+		return 0, 0, errNotFound
+	}
+	return openTime, delay, err
+}
+
+func (s sqliteStorage) setIPDelay(ip string, openTime, delay int) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO ip_delays
+		(ip, open_time, delay) VALUES (?, ?, ?)`, ip, openTime, delay)
+	return err
+}
+
+func (s sqliteStorage) removeIPDelay(ip string) error {
+	_, err := s.db.Exec(`DELETE FROM ip_delays WHERE ip = ?`, ip)
+	return err
+}
+
+func (s sqliteStorage) getAccountDelay(name string) (int, int, int, error) {
+	var openTime, delay, failures int
+	err := s.db.QueryRow(`SELECT open_time, delay, failures
+		FROM account_delays WHERE name = ?`, name).Scan(&openTime,
+		&delay, &failures)
+	if err == sql.ErrNoRows {
+		return 0, 0, 0, errNotFound
+	}
+	return openTime, delay, failures, err
+}
+
+func (s sqliteStorage) setAccountDelay(name string, openTime, delay,
+	failures int) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO account_delays
+		(name, open_time, delay, failures) VALUES (?, ?, ?, ?)`,
+		name, openTime, delay, failures)
+	return err
+}
+
+func (s sqliteStorage) removeAccountDelay(name string) error {
+	_, err := s.db.Exec(`DELETE FROM account_delays WHERE name = ?`, name)
+	return err
+}
+
+func (s sqliteStorage) addSession(se session) error {
+	_, err := s.db.Exec(`INSERT INTO sessions
+		(id, name, created, expires, client) VALUES (?, ?, ?, ?, ?)`,
+		se.id, se.name, se.created, se.expires, se.client)
+	return err
+}
+
+func (s sqliteStorage) getSession(id string) (session, error) {
+	se := session{id: id}
+	err := s.db.QueryRow(`SELECT name, created, expires, client
+		FROM sessions WHERE id = ?`, id).Scan(&se.name, &se.created,
+		&se.expires, &se.client)
+	if err == sql.ErrNoRows {
+		return session{}, errNotFound
+	}
+	return se, err
+}
+
+func (s sqliteStorage) sessionsOf(name string) ([]session, error) {
+	rows, err := s.db.Query(`SELECT id, created, expires, client
+		FROM sessions WHERE name = ? ORDER BY rowid`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []session
+	for rows.Next() {
+		se := session{name: name}
+		err := rows.Scan(&se.id, &se.created, &se.expires, &se.client)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, se)
+	}
+	return sessions, rows.Err()
+}
+
+func (s sqliteStorage) removeSession(id string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	return err
+}
+
+func (s sqliteStorage) removeSessionsOf(name string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE name = ?`, name)
+	return err
+}
+
+func (s sqliteStorage) addAPIToken(t apiToken) error {
+	result, err := s.db.Exec(`INSERT OR IGNORE INTO api_tokens
+		(id, name, label, scopes, created) VALUES (?, ?, ?, ?, ?)`,
+		t.id, t.name, t.label, t.scopes, t.created)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if 0 == n {
+		return errExists
+	}
+	return nil
+}
+
+func (s sqliteStorage) getAPIToken(id string) (apiToken, error) {
+	t := apiToken{id: id}
+	err := s.db.QueryRow(`SELECT name, label, scopes, created
+		FROM api_tokens WHERE id = ?`, id).Scan(&t.name, &t.label,
+		&t.scopes, &t.created)
+	if err == sql.ErrNoRows {
+		return apiToken{}, errNotFound
+	}
+	return t, err
+}
+
+func (s sqliteStorage) apiTokensOf(name string) ([]apiToken, error) {
+	rows, err := s.db.Query(`SELECT id, label, scopes, created
+		FROM api_tokens WHERE name = ? ORDER BY rowid`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var apiTokens []apiToken
+	for rows.Next() {
+		t := apiToken{name: name}
+		err := rows.Scan(&t.id, &t.label, &t.scopes, &t.created)
+		if err != nil {
+			return nil, err
+		}
+		apiTokens = append(apiTokens, t)
+	}
+	return apiTokens, rows.Err()
+}
+
+func (s sqliteStorage) removeAPIToken(id string) error {
+	_, err := s.db.Exec(`DELETE FROM api_tokens WHERE id = ?`, id)
+	return err
+}
+
+func (s sqliteStorage) getTwoFactor(name string) (twoFactor, error) {
+	t := twoFactor{name: name}
+	var recovery string
+	err := s.db.QueryRow(`SELECT secret, last_step, recovery
+		FROM two_factor WHERE name = ?`, name).Scan(&t.secret,
+		&t.lastStep, &recovery)
+	if err == sql.ErrNoRows {
+		return twoFactor{}, errNotFound
+	} else if err != nil {
+		return twoFactor{}, err
+	}
+	if "" != recovery {
+		t.recovery = strings.Split(recovery, ",")
+	}
+	return t, nil
+}
+
+func (s sqliteStorage) setTwoFactor(t twoFactor) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO two_factor
+		(name, secret, last_step, recovery) VALUES (?, ?, ?, ?)`,
+		t.name, t.secret, t.lastStep, strings.Join(t.recovery, ","))
+	return err
+}
+
+func (s sqliteStorage) useTOTPStep(name string, step int) (bool, error) {
+	result, err := s.db.Exec(`UPDATE two_factor SET last_step = ?
+		WHERE name = ? AND last_step < ?`, step, name, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return 1 == n, err
+}
+
+// useRecoveryCode reads and writes the remaining codes in one transaction, so
+// a code can't be used by two concurrent logins.
+func (s sqliteStorage) useRecoveryCode(name, hash string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var recovery string
+	err = tx.QueryRow(`SELECT recovery FROM two_factor WHERE name = ?`,
+		name).Scan(&recovery)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	hashes := strings.Split(recovery, ",")
+	for i, h := range hashes {
+		if hash != h {
+			continue
+		}
+		hashes = append(hashes[:i], hashes[i+1:]...)
+		_, err := tx.Exec(`UPDATE two_factor SET recovery = ?
+			WHERE name = ?`, strings.Join(hashes, ","), name)
+		if err != nil {
+			return false, err
+		}
+		return true, tx.Commit()
+	}
+	return false, nil
+}
+
+func (s sqliteStorage) removeTwoFactor(name string) error {
+	_, err := s.db.Exec(`DELETE FROM two_factor WHERE name = ?`, name)
+	return err
+}
+
+// addMailVerification replaces any pending verification of another address
+// for name.
+func (s sqliteStorage) addMailVerification(selector, hash, name, mail string,
+	createTime int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM mail_verification WHERE name = ?`, name)
+	if err == nil {
+		_, err = tx.Exec(`INSERT INTO mail_verification
+			(selector, name, mail, create_time, hash)
+			VALUES (?, ?, ?, ?, ?)`, selector, name, mail,
+			createTime, hash)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s sqliteStorage) getMailVerification(selector string) (string, string,
+	string, int, error) {
+	var name, mail, hash string
+	var createTime int
+	err := s.db.QueryRow(`SELECT name, mail, hash, create_time
+		FROM mail_verification WHERE selector = ?`, selector).Scan(
+		&name, &mail, &hash, &createTime)
+	if err == sql.ErrNoRows {
+		return "", "", "", 0, errNotFound
+	}
+	return name, mail, hash, createTime, err
+}
+
+func (s sqliteStorage) removeMailVerification(selector string) error {
+	_, err := s.db.Exec(`DELETE FROM mail_verification WHERE selector = ?`,
+		selector)
+	return err
+}
+
+func (s sqliteStorage) removeMailVerificationsOf(name string) error {
+	_, err := s.db.Exec(`DELETE FROM mail_verification WHERE name = ?`,
+		name)
+	return err
+}
+
+func (s sqliteStorage) removePwResetsBefore(createTime int) error {
+	_, err := s.db.Exec(`DELETE FROM password_reset WHERE create_time < ?`,
+		createTime)
+	return err
+}
+
+func (s sqliteStorage) removePwResetWaitsBefore(lastTime int) error {
+	_, err := s.db.Exec(`DELETE FROM password_reset_wait
+		WHERE last_time < ?`, lastTime)
+	return err
+}
+
+func (s sqliteStorage) removeIPDelaysBefore(openTime int) error {
+	_, err := s.db.Exec(`DELETE FROM ip_delays WHERE open_time < ?`,
+		openTime)
+	return err
+}
+
+func (s sqliteStorage) removeAccountDelaysBefore(openTime,
+	lockout int) error {
+	_, err := s.db.Exec(`DELETE FROM account_delays WHERE open_time < ?
+		AND (0 = ? OR failures < ?)`, openTime, lockout, lockout)
+	return err
+}
+
+func (s sqliteStorage) removeSessionsBefore(expires int) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE expires < ?`, expires)
+	return err
+}
+
+func (s sqliteStorage) removeMailVerificationsBefore(createTime int) error {
+	_, err := s.db.Exec(`DELETE FROM mail_verification
+		WHERE create_time < ?`, createTime)
+	return err
+}
+
+// importTextFiles copies the contents of the text files below dataDir into
+// the database in a single transaction. Entries already present in the
+// database make the whole import fail rather than be silently overwritten.
+func (s sqliteStorage) importTextFiles() error {
+	imports := []struct {
+		path      string
+		nTokens   int
+		statement string
+	}{
+		{loginsPath, nLoginTokens, `INSERT INTO logins
+			(name, hash, mail, secquestion, secanswer)
+			VALUES (?, ?, ?, ?, ?)`},
+		{pwResetPath, 4, `INSERT INTO password_reset
+			(selector, name, create_time, hash)
+			VALUES (?, ?, ?, ?)`},
+		{pwResetWaitPath, 2, `INSERT INTO password_reset_wait
+			(name, last_time) VALUES (?, ?)`},
+		{ipDelaysPath, 3, `INSERT INTO ip_delays
+			(ip, open_time, delay) VALUES (?, ?, ?)`},
+		{accountDelaysPath, 4, `INSERT INTO account_delays
+			(name, open_time, delay, failures)
+			VALUES (?, ?, ?, ?)`},
+		{sessionsPath, 5, `INSERT INTO sessions
+			(id, name, created, expires, client)
+			VALUES (?, ?, ?, ?, ?)`},
+		{apiTokensPath, 5, `INSERT INTO api_tokens
+			(id, name, label, scopes, created)
+			VALUES (?, ?, ?, ?, ?)`},
+		{twoFactorPath, 4, `INSERT INTO two_factor
+			(name, secret, last_step, recovery)
+			VALUES (?, ?, ?, ?)`},
+		{mailVerifyPath, 5, `INSERT INTO mail_verification
+			(selector, name, mail, create_time, hash)
+			VALUES (?, ?, ?, ?, ?)`}}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, imp := range imports {
+		lines, err := linesFromFile(imp.path)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		for i, line := range lines {
+			if "" == line {
+				continue
+			}
+			tokens := strings.Split(line, "\t")
+			if len(tokens) != imp.nTokens {
+				tx.Rollback()
+				return errors.New("Malformed line " +
+					strconv.Itoa(i+1) + " in " + imp.path)
+			}
+			args := make([]interface{}, len(tokens))
+			for j, token := range tokens {
+				args[j] = token
+			}
+			_, err := tx.Exec(imp.statement, args...)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
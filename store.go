@@ -0,0 +1,545 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "errors"
+import "io/ioutil"
+import "os"
+import "strconv"
+import "strings"
+import "time"
+
+var errExists = errors.New("Entry already exists.")
+var errNotFound = errors.New("No such entry.")
+
+var store storage
+
+type user struct {
+	name        string
+	hash        string
+	mail        string
+	secQuestion string
+	secAnswer   string
+}
+
+type session struct {
+	id      string
+	name    string
+	created int
+	expires int
+	client  string
+}
+
+// apiToken grants scripts the scopes (comma-separated) of its user's rights.
+// Only a hash of the token itself is kept, as its id.
+type apiToken struct {
+	id      string
+	name    string
+	label   string
+	scopes  string
+	created int
+}
+
+// twoFactor holds a user's TOTP secret, the last time step a code was
+// accepted for, and the hashes of their unused recovery codes.
+type twoFactor struct {
+	name     string
+	secret   string
+	lastStep int
+	recovery []string
+}
+
+// storage is what handlers and main read and write persistent data through.
+// Lookups report missing entries with errNotFound, addUser reports a taken
+// name with errExists; anything else returned as an error is a failure of the
+// backend itself. Implementations must be safe for concurrent use.
+type storage interface {
+	getUser(name string) (user, error)
+	addUser(u user) error
+	updateUser(u user) error
+	userNames() ([]string, error)
+	appendToFeed(name, line string) error
+	getFeed(name string) ([]byte, time.Time, error)
+	addPwReset(selector, hash, name string, createTime int) error
+	getPwReset(selector string) (string, string, int, error)
+	removePwReset(selector string) error
+	getPwResetWait(name string) (int, error)
+	setPwResetWait(name string, lastTime int) error
+	getIPDelay(ip string) (int, int, error)
+	setIPDelay(ip string, openTime, delay int) error
+	removeIPDelay(ip string) error
+	getAccountDelay(name string) (int, int, int, error)
+	setAccountDelay(name string, openTime, delay, failures int) error
+	removeAccountDelay(name string) error
+	addSession(s session) error
+	getSession(id string) (session, error)
+	sessionsOf(name string) ([]session, error)
+	removeSession(id string) error
+	removeSessionsOf(name string) error
+	addAPIToken(t apiToken) error
+	getAPIToken(id string) (apiToken, error)
+	apiTokensOf(name string) ([]apiToken, error)
+	removeAPIToken(id string) error
+	getTwoFactor(name string) (twoFactor, error)
+	setTwoFactor(t twoFactor) error
+	useTOTPStep(name string, step int) (bool, error)
+	useRecoveryCode(name, hash string) (bool, error)
+	removeTwoFactor(name string) error
+	addMailVerification(selector, hash, name, mail string,
+		createTime int) error
+	getMailVerification(selector string) (string, string, string, int,
+		error)
+	removeMailVerification(selector string) error
+	removeMailVerificationsOf(name string) error
+	removePwResetsBefore(createTime int) error
+	removePwResetWaitsBefore(lastTime int) error
+	removeIPDelaysBefore(openTime int) error
+	removeAccountDelaysBefore(openTime, lockout int) error
+	removeSessionsBefore(expires int) error
+	removeMailVerificationsBefore(createTime int) error
+}
+
+// fileStorage keeps everything in tab-separated text files below dataDir.
+type fileStorage struct {
+	logins *lineIndex
+}
+
+func newFileStorage() fileStorage {
+	return fileStorage{logins: newLineIndex(loginsPath, nLoginTokens)}
+}
+
+func userFromTokens(name string, tokens []string) user {
+	return user{name: name, hash: tokens[0], mail: tokens[1],
+		secQuestion: tokens[2], secAnswer: tokens[3]}
+}
+
+func lineFromUser(u user) string {
+	return strings.Join([]string{u.name, u.hash, u.mail, u.secQuestion,
+		u.secAnswer}, "\t")
+}
+
+func (s fileStorage) getUser(name string) (user, error) {
+	tokens, err := s.logins.get(name)
+	if err != nil {
+		return user{}, err
+	}
+	return userFromTokens(name, tokens), nil
+}
+
+func (fileStorage) addUser(u user) error {
+	added, err := appendToFileIfNew(loginsPath, u.name, lineFromUser(u))
+	if err != nil {
+		return err
+	} else if !added {
+		return errExists
+	}
+	return nil
+}
+
+func (fileStorage) updateUser(u user) error {
+	return replaceLineStartingWith(loginsPath, u.name, lineFromUser(u))
+}
+
+func (fileStorage) userNames() ([]string, error) {
+	lines, err := linesFromFile(loginsPath)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range lines {
+		if "" == line {
+			continue
+		}
+		names = append(names, strings.Split(line, "\t")[0])
+	}
+	return names, nil
+}
+
+// Feeds are files below feedsPath whatever the storage, so both
+// implementations use these.
+func appendToFeedFile(name, line string) error {
+	return appendInPlace(feedsPath+"/"+name, line)
+}
+
+func readFeedFile(name string) ([]byte, time.Time, error) {
+	path := feedsPath + "/" + name
+	unlock, err := lockFile(path, false)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer unlock()
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, errNotFound
+	} else if err != nil {
+		return nil, time.Time{}, err
+	}
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return text, info.ModTime(), nil
+}
+
+func (fileStorage) appendToFeed(name, line string) error {
+	return appendToFeedFile(name, line)
+}
+
+func (fileStorage) getFeed(name string) ([]byte, time.Time, error) {
+	return readFeedFile(name)
+}
+
+// addPwReset stores a password reset link by the selector part of its secret
+// and the hash of the rest.
+func (fileStorage) addPwReset(selector, hash, name string,
+	createTime int) error {
+	return appendToFile(pwResetPath, selector+"\t"+name+"\t"+
+		strconv.Itoa(createTime)+"\t"+hash)
+}
+
+// getPwReset returns the name, hash and creation time of the password reset
+// link of selector.
+func (fileStorage) getPwReset(selector string) (string, string, int, error) {
+	tokens, err := getFromFileEntryFor(pwResetPath, selector, 4)
+	if err != nil {
+		return "", "", 0, err
+	}
+	createTime, err := strconv.Atoi(tokens[1])
+	if err != nil {
+		return "", "", 0, errors.New("Can't read time from pw reset " +
+			"file.")
+	}
+	return tokens[0], tokens[2], createTime, nil
+}
+
+func (fileStorage) removePwReset(selector string) error {
+	return removeLineStartingWith(pwResetPath, selector)
+}
+
+func (fileStorage) getPwResetWait(name string) (int, error) {
+	tokens, err := getFromFileEntryFor(pwResetWaitPath, name, 2)
+	if err != nil {
+		return 0, err
+	}
+	lastTime, err := strconv.Atoi(tokens[0])
+	if err != nil {
+		return 0, errors.New("Can't parse password reset wait times.")
+	}
+	return lastTime, nil
+}
+
+func (fileStorage) setPwResetWait(name string, lastTime int) error {
+	line := name + "\t" + strconv.Itoa(lastTime)
+	return replaceOrAppendLine(pwResetWaitPath, name, line)
+}
+
+func (fileStorage) getIPDelay(ip string) (int, int, error) {
+	tokens, err := getFromFileEntryFor(ipDelaysPath, ip, 3)
+	if err != nil {
+		return 0, 0, err
+	}
+	openTime, err := strconv.Atoi(tokens[0])
+	if err != nil {
+		return 0, 0, errors.New("Can't parse IP delays file.")
+	}
+	delay, err := strconv.Atoi(tokens[1])
+	if err != nil {
+		return 0, 0, errors.New("Can't parse IP delays file.")
+	}
+	return openTime, delay, nil
+}
+
+func (fileStorage) setIPDelay(ip string, openTime, delay int) error {
+	line := ip + "\t" + strconv.Itoa(openTime) + "\t" + strconv.Itoa(delay)
+	return replaceOrAppendLine(ipDelaysPath, ip, line)
+}
+
+func (fileStorage) removeIPDelay(ip string) error {
+	return removeLineStartingWith(ipDelaysPath, ip)
+}
+
+// getAccountDelay returns, besides what getIPDelay does for IPs, the number
+// of failed logins in a row to the account name.
+func (fileStorage) getAccountDelay(name string) (int, int, int, error) {
+	tokens, err := getFromFileEntryFor(accountDelaysPath, name, 4)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var numbers [3]int
+	for i, token := range tokens {
+		numbers[i], err = strconv.Atoi(token)
+		if err != nil {
+			return 0, 0, 0, errors.New("Can't parse account " +
+				"delays file.")
+		}
+	}
+	return numbers[0], numbers[1], numbers[2], nil
+}
+
+func (fileStorage) setAccountDelay(name string, openTime, delay,
+	failures int) error {
+	line := name + "\t" + strconv.Itoa(openTime) + "\t" +
+		strconv.Itoa(delay) + "\t" + strconv.Itoa(failures)
+	return replaceOrAppendLine(accountDelaysPath, name, line)
+}
+
+func (fileStorage) removeAccountDelay(name string) error {
+	return removeLineStartingWith(accountDelaysPath, name)
+}
+
+func sessionFromTokens(tokens []string) (session, error) {
+	created, err := strconv.Atoi(tokens[2])
+	if err != nil {
+		return session{}, errors.New("Can't parse sessions file.")
+	}
+	expires, err := strconv.Atoi(tokens[3])
+	if err != nil {
+		return session{}, errors.New("Can't parse sessions file.")
+	}
+	return session{id: tokens[0], name: tokens[1], created: created,
+		expires: expires, client: tokens[4]}, nil
+}
+
+func (fileStorage) addSession(s session) error {
+	return appendToFile(sessionsPath, strings.Join([]string{s.id, s.name,
+		strconv.Itoa(s.created), strconv.Itoa(s.expires), s.client},
+		"\t"))
+}
+
+func (fileStorage) getSession(id string) (session, error) {
+	tokens, err := getFromFileEntryFor(sessionsPath, id, 5)
+	if err != nil {
+		return session{}, err
+	}
+	return sessionFromTokens(append([]string{id}, tokens...))
+}
+
+func (fileStorage) sessionsOf(name string) ([]session, error) {
+	lines, err := linesFromFile(sessionsPath)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []session
+	for _, line := range lines {
+		tokens := strings.Split(line, "\t")
+		if 5 != len(tokens) || name != tokens[1] {
+			continue
+		}
+		s, err := sessionFromTokens(tokens)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+func (fileStorage) removeSession(id string) error {
+	return removeLineStartingWith(sessionsPath, id)
+}
+
+func (fileStorage) removeSessionsOf(name string) error {
+	return removeLinesWhere(sessionsPath, func(tokens []string) bool {
+		return len(tokens) > 1 && name == tokens[1]
+	})
+}
+
+func apiTokenFromTokens(tokens []string) (apiToken, error) {
+	created, err := strconv.Atoi(tokens[4])
+	if err != nil {
+		return apiToken{}, errors.New("Can't parse API tokens file.")
+	}
+	return apiToken{id: tokens[0], name: tokens[1], label: tokens[2],
+		scopes: tokens[3], created: created}, nil
+}
+
+// addAPIToken returns errExists if t's user already has a token of t's label.
+func (fileStorage) addAPIToken(t apiToken) error {
+	line := strings.Join([]string{t.id, t.name, t.label, t.scopes,
+		strconv.Itoa(t.created)}, "\t")
+	added, err := appendToFileUnless(apiTokensPath, line,
+		func(tokens []string) bool {
+			return len(tokens) > 2 && t.name == tokens[1] &&
+				t.label == tokens[2]
+		})
+	if err == nil && !added {
+		return errExists
+	}
+	return err
+}
+
+func (fileStorage) getAPIToken(id string) (apiToken, error) {
+	tokens, err := getFromFileEntryFor(apiTokensPath, id, 5)
+	if err != nil {
+		return apiToken{}, err
+	}
+	return apiTokenFromTokens(append([]string{id}, tokens...))
+}
+
+func (fileStorage) apiTokensOf(name string) ([]apiToken, error) {
+	lines, err := linesFromFile(apiTokensPath)
+	if err != nil {
+		return nil, err
+	}
+	var apiTokens []apiToken
+	for _, line := range lines {
+		tokens := strings.Split(line, "\t")
+		if 5 != len(tokens) || name != tokens[1] {
+			continue
+		}
+		t, err := apiTokenFromTokens(tokens)
+		if err != nil {
+			return nil, err
+		}
+		apiTokens = append(apiTokens, t)
+	}
+	return apiTokens, nil
+}
+
+func (fileStorage) removeAPIToken(id string) error {
+	return removeLineStartingWith(apiTokensPath, id)
+}
+
+func (fileStorage) getTwoFactor(name string) (twoFactor, error) {
+	tokens, err := getFromFileEntryFor(twoFactorPath, name, 4)
+	if err != nil {
+		return twoFactor{}, err
+	}
+	lastStep, err := strconv.Atoi(tokens[1])
+	if err != nil {
+		return twoFactor{}, errors.New("Can't parse two-factor file.")
+	}
+	t := twoFactor{name: name, secret: tokens[0], lastStep: lastStep}
+	if "" != tokens[2] {
+		t.recovery = strings.Split(tokens[2], ",")
+	}
+	return t, nil
+}
+
+func (fileStorage) setTwoFactor(t twoFactor) error {
+	return replaceOrAppendLine(twoFactorPath, t.name, strings.Join(
+		[]string{t.name, t.secret, strconv.Itoa(t.lastStep),
+			strings.Join(t.recovery, ",")}, "\t"))
+}
+
+// useTOTPStep records step as the last one a code was accepted for, unless
+// that is not older, and returns whether it did. Checking and recording in
+// one go keeps concurrent logins from using the same code twice.
+func (fileStorage) useTOTPStep(name string, step int) (bool, error) {
+	return updateLineStartingWith(twoFactorPath, name,
+		func(tokens []string) bool {
+			lastStep, err := strconv.Atoi(tokens[2])
+			if err != nil || lastStep >= step {
+				return false
+			}
+			tokens[2] = strconv.Itoa(step)
+			return true
+		})
+}
+
+// useRecoveryCode removes hash from name's recovery codes and returns
+// whether it was among them.
+func (fileStorage) useRecoveryCode(name, hash string) (bool, error) {
+	return updateLineStartingWith(twoFactorPath, name,
+		func(tokens []string) bool {
+			hashes := strings.Split(tokens[3], ",")
+			for i, h := range hashes {
+				if hash == h {
+					hashes = append(hashes[:i],
+						hashes[i+1:]...)
+					tokens[3] = strings.Join(hashes, ",")
+					return true
+				}
+			}
+			return false
+		})
+}
+
+func (fileStorage) removeTwoFactor(name string) error {
+	return removeLineStartingWith(twoFactorPath, name)
+}
+
+// addMailVerification stores a mail address verification link like a password
+// reset one, replacing any pending verification of another address for name.
+func (s fileStorage) addMailVerification(selector, hash, name, mail string,
+	createTime int) error {
+	if err := s.removeMailVerificationsOf(name); err != nil {
+		return err
+	}
+	return appendToFile(mailVerifyPath, strings.Join([]string{selector,
+		name, mail, strconv.Itoa(createTime), hash}, "\t"))
+}
+
+// getMailVerification returns the name, address, hash and creation time of
+// the mail address verification link of selector.
+func (fileStorage) getMailVerification(selector string) (string, string,
+	string, int, error) {
+	tokens, err := getFromFileEntryFor(mailVerifyPath, selector, 5)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	createTime, err := strconv.Atoi(tokens[2])
+	if err != nil {
+		return "", "", "", 0, errors.New("Can't read time from mail " +
+			"verification file.")
+	}
+	return tokens[0], tokens[1], tokens[3], createTime, nil
+}
+
+func (fileStorage) removeMailVerification(selector string) error {
+	return removeLineStartingWith(mailVerifyPath, selector)
+}
+
+func (fileStorage) removeMailVerificationsOf(name string) error {
+	return removeLinesWhere(mailVerifyPath, func(tokens []string) bool {
+		return 2 <= len(tokens) && name == tokens[1]
+	})
+}
+
+// removeLinesBefore removes the lines of path whose i-th token is a number
+// smaller than limit.
+func removeLinesBefore(path string, i, limit int) error {
+	return removeLinesWhere(path, func(tokens []string) bool {
+		if i >= len(tokens) {
+			return false
+		}
+		n, err := strconv.Atoi(tokens[i])
+		return err == nil && n < limit
+	})
+}
+
+func (fileStorage) removePwResetsBefore(createTime int) error {
+	return removeLinesBefore(pwResetPath, 2, createTime)
+}
+
+func (fileStorage) removePwResetWaitsBefore(lastTime int) error {
+	return removeLinesBefore(pwResetWaitPath, 1, lastTime)
+}
+
+func (fileStorage) removeIPDelaysBefore(openTime int) error {
+	return removeLinesBefore(ipDelaysPath, 1, openTime)
+}
+
+// removeAccountDelaysBefore spares accounts locked after lockout failures,
+// unless lockout is 0.
+func (fileStorage) removeAccountDelaysBefore(openTime, lockout int) error {
+	return removeLinesWhere(accountDelaysPath, func(tokens []string) bool {
+		if 4 != len(tokens) {
+			return false
+		}
+		stored, err := strconv.Atoi(tokens[1])
+		if err != nil || stored >= openTime {
+			return false
+		}
+		failures, err := strconv.Atoi(tokens[3])
+		return err == nil && (0 == lockout || failures < lockout)
+	})
+}
+
+func (fileStorage) removeSessionsBefore(expires int) error {
+	return removeLinesBefore(sessionsPath, 3, expires)
+}
+
+func (fileStorage) removeMailVerificationsBefore(createTime int) error {
+	return removeLinesBefore(mailVerifyPath, 3, createTime)
+}
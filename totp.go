@@ -0,0 +1,145 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha1"
+import "crypto/sha256"
+import "crypto/subtle"
+import "encoding/base32"
+import "encoding/base64"
+import "encoding/binary"
+import "encoding/hex"
+import "fmt"
+import "html/template"
+import "net/url"
+import "rsc.io/qr"
+import "strings"
+import "time"
+
+// TOTP codes as per RFC 6238: six digits, derived from a new 30-second time
+// step each, of which the ones adjacent to the current one are accepted, too,
+// to allow for clock drift.
+const totpPeriod = 30
+const totpSkew = 1
+const nRecoveryCodes = 10
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+// totpStep returns the time step for which code is valid under secret, or -1
+// if there is none within the accepted skew of now that is newer than
+// lastStep. Refusing steps not newer than lastStep keeps codes from being
+// used twice.
+func totpStep(secret, code string, lastStep int) int {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || 6 != len(code) {
+		return -1
+	}
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= int64(lastStep) {
+			continue
+		}
+		if 1 == subtle.ConstantTimeCompare([]byte(code),
+			[]byte(totpCode(key, step))) {
+			return int(step)
+		}
+	}
+	return -1
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(ru rune) rune {
+		if '-' == ru || ' ' == ru {
+			return -1
+		}
+		return ru
+	}, strings.ToLower(code))
+}
+
+func recoveryCodeHash(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes returns codes to show to the user and the hashes of them
+// to store. With 80 random bits each, the codes are too many to guess or to
+// find from their unsalted hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	var codes, hashes []string
+	for i := 0; i < nRecoveryCodes; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		code = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" +
+			code[12:]
+		codes = append(codes, code)
+		hashes = append(hashes, recoveryCodeHash(code))
+	}
+	return codes, hashes, nil
+}
+
+// checkSecondFactor returns whether code is a valid TOTP code or unused
+// recovery code for name, and consumes it if so. Users without two-factor
+// authentication pass with any code.
+func checkSecondFactor(name, code string) (bool, error) {
+	t, err := store.getTwoFactor(name)
+	if err == errNotFound {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	code = strings.TrimSpace(code)
+	if step := totpStep(t.secret, code, t.lastStep); -1 != step {
+		return store.useTOTPStep(name, step)
+	}
+	hash := recoveryCodeHash(code)
+	for _, recoveryHash := range t.recovery {
+		if 1 == subtle.ConstantTimeCompare([]byte(hash),
+			[]byte(recoveryHash)) {
+			return store.useRecoveryCode(name, hash)
+		}
+	}
+	return false, nil
+}
+
+// totpURI is what authenticator apps expect to be fed, usually by QR code.
+func totpURI(name, secret string) string {
+	label := "htwtxt"
+	if "" != name {
+		label += ":" + name
+	}
+	return "otpauth://totp/" + url.PathEscape(label) + "?secret=" +
+		secret + "&issuer=htwtxt"
+}
+
+func qrDataURI(text string) (template.URL, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," +
+		base64.StdEncoding.EncodeToString(code.PNG())), nil
+}
@@ -0,0 +1,132 @@
+// htwtxt – hosted twtxt server; see README for copyright and license info
+
+package main
+
+import "runtime"
+import "sync"
+import "sync/atomic"
+import "testing"
+import "time"
+
+// The SHA-1 test vectors of RFC 6238, appendix B, cut to six digits.
+func TestTOTPCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		code := totpCode(key, test.time/totpPeriod)
+		if test.code != code {
+			t.Errorf("time %d: got %s, want %s", test.time, code,
+				test.code)
+		}
+	}
+}
+
+func TestTOTPStep(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secret := totpEncoding.EncodeToString(key)
+	code := func(step int64) string { return totpCode(key, step) }
+	// Should a new time step begin while checking, check again.
+	for {
+		now := time.Now().Unix() / totpPeriod
+		tests := []struct {
+			secret   string
+			code     string
+			lastStep int64
+			step     int64
+		}{
+			{secret, code(now), 0, now},
+			{secret, code(now - totpSkew), 0, now - totpSkew},
+			{secret, code(now + totpSkew), 0, now + totpSkew},
+			{secret, code(now - totpSkew - 1), 0, -1},
+			{secret, code(now + totpSkew + 1), 0, -1},
+			{secret, code(now), now - 1, now},
+			{secret, code(now), now, -1},
+			{secret, code(now - totpSkew), now, -1},
+			{secret, code(now)[1:], 0, -1},
+			{"not base32!", code(now), 0, -1},
+		}
+		var failed []int
+		for i, test := range tests {
+			step := totpStep(test.secret, test.code,
+				int(test.lastStep))
+			if int(test.step) != step {
+				failed = append(failed, i)
+			}
+		}
+		if time.Now().Unix()/totpPeriod != now {
+			continue
+		}
+		for _, i := range failed {
+			t.Errorf("case %d: code %s wrongly accepted or refused",
+				i, tests[i].code)
+		}
+		return
+	}
+}
+
+func TestCheckSecondFactorOnce(t *testing.T) {
+	dataDir = t.TempDir()
+	initFilesAndDirs()
+	db, err := newSqliteStorage(dataDir + "/htwtxt.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.db.Close()
+	// Let the checks overlap even on machines with a single core.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	key := []byte("12345678901234567890")
+	for _, s := range []storage{newFileStorage(), db} {
+		store = s
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret := totpEncoding.EncodeToString(key)
+		err = store.setTwoFactor(twoFactor{name: "foo", secret: secret,
+			recovery: hashes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now().Unix() / totpPeriod
+		for _, code := range []string{totpCode(key, now), codes[3]} {
+			var passed int32
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ok, err := checkSecondFactor("foo",
+						code)
+					if err != nil {
+						t.Error(err)
+					} else if ok {
+						atomic.AddInt32(&passed, 1)
+					}
+				}()
+			}
+			wg.Wait()
+			if 1 != passed {
+				t.Errorf("%T: code %s passed %d times", s, code,
+					passed)
+			}
+		}
+		tf, err := store.getTwoFactor("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nRecoveryCodes-1 != len(tf.recovery) {
+			t.Errorf("%T: got %d recovery codes left", s,
+				len(tf.recovery))
+		}
+	}
+}